@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const authCacheKeyPrefix = "auth_cache__"
+
+func (handler *ChargePointHandler) OnClearCache(request *core.ClearCacheRequest) (confirmation *core.ClearCacheConfirmation, err error) {
+	appLogger.Println("OnClearCache", request.GetFeatureName())
+
+	if err := db.Update(clearAuthCacheTX); err != nil {
+		appLogger.WithError(err).Error("Error clearing authorization cache")
+		return core.NewClearCacheConfirmation(core.ClearCacheStatusRejected), nil
+	}
+	return core.NewClearCacheConfirmation(core.ClearCacheStatusAccepted), nil
+}
+
+// updateAuthCache remembers the IdTagInfo the central system returned for
+// idTag, as long as AuthorizationCacheEnabled is set.
+func updateAuthCache(idTag string, info *types.IdTagInfo) {
+	if idTag == "" || info == nil || !MustGetBoolKey("AuthorizationCacheEnabled") {
+		return
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(authCacheKeyPrefix+idTag), data)
+	}); err != nil {
+		appLogger.WithError(err).Error("Error updating authorization cache")
+	}
+}
+
+// getAuthCacheEntry returns the cached IdTagInfo of idTag, or nil when it is
+// not cached or the cache is disabled.
+func getAuthCacheEntry(idTag string) (*types.IdTagInfo, error) {
+	if !MustGetBoolKey("AuthorizationCacheEnabled") {
+		return nil, nil
+	}
+	var info *types.IdTagInfo
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(authCacheKeyPrefix + idTag))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info = &types.IdTagInfo{}
+		return json.Unmarshal(v, info)
+	})
+	return info, err
+}
+
+// listAuthCache returns every cached IdTagInfo by idTag.
+func listAuthCache() (map[string]*types.IdTagInfo, error) {
+	entries := map[string]*types.IdTagInfo{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(authCacheKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			info := &types.IdTagInfo{}
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, info)
+			}); err != nil {
+				return err
+			}
+			entries[strings.TrimPrefix(string(it.Item().Key()), authCacheKeyPrefix)] = info
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func clearAuthCacheTX(txn *badger.Txn) error {
+	keys := [][]byte{}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(authCacheKeyPrefix)
+	it := txn.NewIterator(opts)
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
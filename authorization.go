@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+// authorizeIdTagLocally answers an authorization from the local authorization
+// list or else the authorization cache, which are only consulted while offline
+// with LocalAuthorizeOffline or online with LocalPreAuthorize.
+func authorizeIdTagLocally(idTag string) (*types.IdTagInfo, bool) {
+	online := chargePoint != nil && chargePoint.IsConnected()
+	if online && !MustGetBoolKey("LocalPreAuthorize") {
+		return nil, false
+	}
+	if !online && !MustGetBoolKey("LocalAuthorizeOffline") {
+		return nil, false
+	}
+
+	var info *types.IdTagInfo
+	var err error
+	if MustGetBoolKey("LocalAuthListEnabled") {
+		info, err = getLocalListEntry(idTag)
+		if err != nil {
+			appLogger.WithError(err).Error("Error reading local authorization list")
+		}
+	}
+	if info == nil {
+		info, err = getAuthCacheEntry(idTag)
+		if err != nil {
+			appLogger.WithError(err).Error("Error reading authorization cache")
+		}
+	}
+	if info == nil {
+		return nil, false
+	}
+	if info.ExpiryDate != nil && info.ExpiryDate.Before(time.Now()) {
+		expired := *info
+		expired.Status = types.AuthorizationStatusExpired
+		info = &expired
+	}
+
+	// while online only accepted idTags are pre-authorized, anything else is
+	// left to the central system
+	if online && info.Status != types.AuthorizationStatusAccepted {
+		return nil, false
+	}
+	return info, true
+}
+
+// authorizeIdTag authorizes idTag locally when allowed to, otherwise through an
+// Authorize request, and hands the outcome to callback.
+func authorizeIdTag(idTag string, callback func(info *types.IdTagInfo, err error)) error {
+	if info, ok := authorizeIdTagLocally(idTag); ok {
+		appLogger.WithField("idTag", idTag).Println("idTag authorized locally", info.Status)
+		go callback(info, nil)
+		return nil
+	}
+	if chargePoint == nil || !chargePoint.IsConnected() {
+		return errors.New("charge point is offline and idTag is not known locally")
+	}
+
+	return chargePoint.SendRequestAsync(core.NewAuthorizationRequest(idTag), func(resp ocpp.Response, protoError error) {
+		conf, ok := resp.(*core.AuthorizeConfirmation)
+		if !ok {
+			if protoError == nil {
+				protoError = errors.New("unexpected Authorize response")
+			}
+			callback(nil, protoError)
+			return
+		}
+		updateAuthCache(idTag, conf.IdTagInfo)
+		callback(conf.IdTagInfo, nil)
+	})
+}
+
+// authorizeIdTagSync is authorizeIdTag waiting for the outcome, it must not be
+// called from a handler.
+func authorizeIdTagSync(idTag string) (*types.IdTagInfo, error) {
+	type result struct {
+		info *types.IdTagInfo
+		err  error
+	}
+	c := make(chan result, 1)
+	if err := authorizeIdTag(idTag, func(info *types.IdTagInfo, err error) {
+		c <- result{info, err}
+	}); err != nil {
+		return nil, err
+	}
+	r := <-c
+	return r.info, r.err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+)
+
+// OnChangeAvailability persists the requested availability right away, a
+// connector with a transaction in progress only becomes Unavailable once the
+// transaction ended.
+func (handler *ChargePointHandler) OnChangeAvailability(request *core.ChangeAvailabilityRequest) (confirmation *core.ChangeAvailabilityConfirmation, err error) {
+	connectorId := request.ConnectorId
+	appLogger.Println("OnChangeAvailability", connectorId, request.Type)
+
+	if connectorId < 0 || connectorId > numberOfConnectors() {
+		return core.NewChangeAvailabilityConfirmation(core.AvailabilityStatusRejected), nil
+	}
+	if request.Type != core.AvailabilityTypeOperative && request.Type != core.AvailabilityTypeInoperative {
+		return core.NewChangeAvailabilityConfirmation(core.AvailabilityStatusRejected), nil
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(availabilityKey(connectorId)), []byte(request.Type))
+	}); err != nil {
+		appLogger.WithError(err).Error("Error storing availability")
+		return core.NewChangeAvailabilityConfirmation(core.AvailabilityStatusRejected), nil
+	}
+
+	affected := []int{connectorId}
+	if connectorId == 0 {
+		affected = triggeredConnectors(nil, 0)
+	}
+
+	status := core.AvailabilityStatusAccepted
+	idle := []int{}
+	for _, id := range affected {
+		// becoming Operative doesn't wait for the transaction, becoming
+		// Inoperative waits for it to end or for the connector to leave
+		// Preparing
+		if request.Type == core.AvailabilityTypeInoperative && id != 0 &&
+			(isTxRunning(id) || connectorStatus(id) == core.ChargePointStatusPreparing) {
+			status = core.AvailabilityStatusScheduled
+			continue
+		}
+		idle = append(idle, id)
+	}
+
+	go func() {
+		for _, id := range idle {
+			applyAvailability(id)
+		}
+	}()
+
+	return core.NewChangeAvailabilityConfirmation(status), nil
+}
+
+func availabilityKey(connectorId int) string {
+	return fmt.Sprintf("connector_availability__%d", connectorId)
+}
+
+// isOperative tells whether the connector may be used, which requires both the
+// connector and the charge point as a whole to be Operative.
+func isOperative(connectorId int) bool {
+	for _, id := range []int{0, connectorId} {
+		availability, _ := GetKeyValue(availabilityKey(id))
+		if core.AvailabilityType(availability) == core.AvailabilityTypeInoperative {
+			return false
+		}
+	}
+	return true
+}
+
+// idleStatus returns the status of the connector when it is not in use.
+func idleStatus(connectorId int) core.ChargePointStatus {
+	if !isOperative(connectorId) {
+		return core.ChargePointStatusUnavailable
+	}
+	return core.ChargePointStatusAvailable
+}
+
+// applyAvailability reports the connector Unavailable, or Available again,
+// following its availability.
+func applyAvailability(connectorId int) {
+	status := idleStatus(connectorId)
+	current := connectorStatus(connectorId)
+	if status == core.ChargePointStatusAvailable && current != core.ChargePointStatusUnavailable {
+		return
+	}
+	if err := setConnectorStatus(connectorId, status, core.NoError); err != nil {
+		appLogger.WithError(err).Error("Error changing availability of connector ", connectorId)
+	}
+}
+
+// setIdleStatus puts a connector that is done being used back to its idle
+// status, an Inoperative connector in Preparing goes through Available as it
+// cannot become Unavailable right away.
+func setIdleStatus(connectorId int) error {
+	status := idleStatus(connectorId)
+	current := connectorStatus(connectorId)
+	if current != status && !isLegalTransition(connectorId, current, status) {
+		if err := setConnectorStatus(connectorId, core.ChargePointStatusAvailable, core.NoError); err != nil {
+			return err
+		}
+	}
+	return setConnectorStatus(connectorId, status, core.NoError)
+}
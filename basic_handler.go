@@ -1,27 +1,28 @@
 package main
 
 import (
+	"time"
+
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
 )
 
-type ChargePointHandler struct{}
+// confirmationDelay gives the central system time to receive the confirmation
+// of a request before the charge point acts on it.
+const confirmationDelay = 500 * time.Millisecond
 
-func (handler *ChargePointHandler) OnChangeAvailability(request *core.ChangeAvailabilityRequest) (confirmation *core.ChangeAvailabilityConfirmation, err error) {
-	appLogger.Println("OnChangeAvailability", request.ConnectorId, request.Type)
-	return core.NewChangeAvailabilityConfirmation(core.AvailabilityStatusAccepted), nil
-}
+type ChargePointHandler struct{}
 
-func (handler *ChargePointHandler) OnClearCache(request *core.ClearCacheRequest) (confirmation *core.ClearCacheConfirmation, err error) {
-	appLogger.Println("OnClearCache", request.GetFeatureName())
-	return core.NewClearCacheConfirmation(core.ClearCacheStatusAccepted), nil
+// afterConfirmation runs fn in the background once the confirmation of the
+// request being handled reached the central system, so that the messages fn
+// sends follow it.
+func afterConfirmation(fn func()) {
+	go func() {
+		time.Sleep(confirmationDelay)
+		fn()
+	}()
 }
 
 func (handler *ChargePointHandler) OnDataTransfer(request *core.DataTransferRequest) (confirmation *core.DataTransferConfirmation, err error) {
 	appLogger.Println("OnDataTransfer", request.VendorId, request.MessageId, request.Data)
 	return core.NewDataTransferConfirmation("someData"), nil
 }
-
-func (handler *ChargePointHandler) OnReset(request *core.ResetRequest) (confirmation *core.ResetConfirmation, err error) {
-	appLogger.Println("OnReset", request.Type)
-	return core.NewResetConfirmation(core.ResetStatusAccepted), nil
-}
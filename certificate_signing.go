@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/security"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const chargePointPendingPrivateKeyKey = "charge_point_pending_private_key"
+
+// requestCertificateSigning generates a new key pair and sends the CSR for it
+// to the central system, the key is kept aside until the signed certificate
+// comes back with CertificateSigned.
+func requestCertificateSigning() error {
+	cpoName, err := GetKeyValue("CpoName")
+	if err != nil {
+		return err
+	}
+	if cpoName == "" {
+		return errors.New("CpoName is not set")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   chargePointId,
+			Organization: []string{cpoName},
+		},
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+	}, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+		return txn.Set([]byte(chargePointPendingPrivateKeyKey), keyPEM)
+	}); err != nil {
+		return err
+	}
+
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})
+	resp, err := chargePoint.SendRequest(security.NewSignCertificateRequest(string(csr)))
+	if err != nil {
+		return err
+	}
+	status := types.GenericStatusRejected
+	if conf, ok := resp.(*security.SignCertificateResponse); ok {
+		status = conf.Status
+	}
+	if status != types.GenericStatusAccepted {
+		// no certificate is coming for the pending key
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(chargePointPendingPrivateKeyKey))
+		})
+		return fmt.Errorf("SignCertificate %s by the central system", status)
+	}
+	appLogger.Println("SignCertificate accepted")
+	return nil
+}
+
+// acceptSignedCertificate validates the certificate chain against the
+// installed CentralSystemRootCertificate and the pending key, and installs it
+// as the ChargePointCertificate used from the next reconnect on.
+func acceptSignedCertificate(chainPEM string) error {
+	return db.Update(func(txn *badger.Txn) error {
+		keyPEM, err := GetKeyValueTX(txn, chargePointPendingPrivateKeyKey)
+		if err != nil {
+			return err
+		}
+		if keyPEM == "" {
+			return errors.New("no certificate signing request pending")
+		}
+
+		chain, err := parseCertificateChainPEM(chainPEM)
+		if err != nil {
+			return err
+		}
+		leaf := chain[0]
+
+		roots, err := certificatePoolTX(txn, types.CentralSystemRootCertificate)
+		if err != nil {
+			return err
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode([]byte(keyPEM))
+		if block == nil {
+			return errors.New("invalid pending private key")
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(key.Public()) {
+			return errors.New("certificate does not match the pending signing request")
+		}
+
+		if _, err := parseClientCertificate(chainPEM, keyPEM); err != nil {
+			return err
+		}
+
+		if err := txn.Set([]byte(chargePointCertificateKey), []byte(chainPEM)); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte(chargePointPrivateKeyKey), []byte(keyPEM)); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(chargePointPendingPrivateKeyKey))
+	})
+}
+
+func parseCertificateChainPEM(data string) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found in chain")
+	}
+	return chain, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const (
+	installedCertificatePrefix = "installed_certificate__"
+
+	defaultCertificateStoreMaxLength = 10
+)
+
+var (
+	errCertificateStoreFull  = errors.New("certificate store is full")
+	errNotRootCertificate    = errors.New("not a self-signed CA certificate")
+	errCertificateInUse      = errors.New("certificate is the last CentralSystemRootCertificate in use")
+	errCertificateNotFound   = errors.New("certificate not found")
+	errUnsupportedHashMethod = errors.New("unsupported hash algorithm")
+)
+
+// InstalledCertificate is a root certificate installed with InstallCertificate,
+// identified by its SHA256 CertificateHashData.
+type InstalledCertificate struct {
+	Use         types.CertificateUse      `json:"use"`
+	Certificate string                    `json:"certificate"`
+	HashData    types.CertificateHashData `json:"hashData"`
+}
+
+func installedCertificateKey(hashData types.CertificateHashData) string {
+	return fmt.Sprintf("%s%s_%s_%s", installedCertificatePrefix,
+		hashData.IssuerNameHash, hashData.IssuerKeyHash, hashData.SerialNumber)
+}
+
+// certificateHashData computes the identifiers OCPP uses for a certificate:
+// the hashes of the issuer name and issuer public key and the serial number.
+// Only root certificates are stored, so the issuer key is the certificate's
+// own key.
+func certificateHashData(cert *x509.Certificate, algorithm types.HashAlgorithmType) (types.CertificateHashData, error) {
+	var h func() hash.Hash
+	switch algorithm {
+	case types.SHA256:
+		h = sha256.New
+	case types.SHA384:
+		h = sha512.New384
+	case types.SHA512:
+		h = sha512.New
+	default:
+		return types.CertificateHashData{}, errUnsupportedHashMethod
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return types.CertificateHashData{}, err
+	}
+
+	digest := func(data []byte) string {
+		d := h()
+		d.Write(data)
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	return types.CertificateHashData{
+		HashAlgorithm:  algorithm,
+		IssuerNameHash: digest(cert.RawIssuer),
+		IssuerKeyHash:  digest(spki.PublicKey.Bytes),
+		SerialNumber:   cert.SerialNumber.Text(16),
+	}, nil
+}
+
+func sameCertificateHashData(a, b types.CertificateHashData) bool {
+	return strings.EqualFold(a.IssuerNameHash, b.IssuerNameHash) &&
+		strings.EqualFold(a.IssuerKeyHash, b.IssuerKeyHash) &&
+		strings.EqualFold(strings.TrimLeft(a.SerialNumber, "0"), strings.TrimLeft(b.SerialNumber, "0"))
+}
+
+// listInstalledCertificatesTX returns the installed certificates of the given
+// use, or all of them when use is empty.
+func listInstalledCertificatesTX(txn *badger.Txn, use types.CertificateUse) ([]InstalledCertificate, error) {
+	certs := []InstalledCertificate{}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(installedCertificatePrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		var cert InstalledCertificate
+		if err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &cert)
+		}); err != nil {
+			return nil, err
+		}
+		if use == "" || cert.Use == use {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// installCertificateTX stores a root certificate, reinstalling an already
+// installed one replaces it and does not count against
+// CertificateStoreMaxLength. Only self-signed CA certificates are accepted,
+// their hash data is computed with their own key as the issuer key.
+func installCertificateTX(txn *badger.Txn, use types.CertificateUse, certificate string) error {
+	cert, err := parseCertificatePEM(certificate)
+	if err != nil {
+		return err
+	}
+	if !cert.IsCA || cert.CheckSignatureFrom(cert) != nil {
+		return errNotRootCertificate
+	}
+	hashData, err := certificateHashData(cert, types.SHA256)
+	if err != nil {
+		return err
+	}
+	key := installedCertificateKey(hashData)
+
+	if _, err := txn.Get([]byte(key)); errors.Is(err, badger.ErrKeyNotFound) {
+		maxLength, err := GetIntKeyTX(txn, "CertificateStoreMaxLength")
+		if err != nil {
+			return err
+		}
+		installed, err := listInstalledCertificatesTX(txn, "")
+		if err != nil {
+			return err
+		}
+		if len(installed) >= maxLength {
+			return errCertificateStoreFull
+		}
+	}
+
+	data, err := json.Marshal(InstalledCertificate{Use: use, Certificate: certificate, HashData: hashData})
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(key), data)
+}
+
+// deleteCertificateTX removes the certificate matching the hash data, the last
+// CentralSystemRootCertificate cannot be removed while a TLS security profile
+// depends on it.
+func deleteCertificateTX(txn *badger.Txn, hashData types.CertificateHashData) error {
+	installed, err := listInstalledCertificatesTX(txn, "")
+	if err != nil {
+		return err
+	}
+	for _, c := range installed {
+		cert, err := parseCertificatePEM(c.Certificate)
+		if err != nil {
+			return err
+		}
+		h, err := certificateHashData(cert, hashData.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		if !sameCertificateHashData(h, hashData) {
+			continue
+		}
+
+		if c.Use == types.CentralSystemRootCertificate {
+			profile, err := GetIntKeyTX(txn, "SecurityProfile")
+			if err != nil {
+				return err
+			}
+			csmsRoots, err := listInstalledCertificatesTX(txn, types.CentralSystemRootCertificate)
+			if err != nil {
+				return err
+			}
+			if profile >= BasicSecurityWithTLSProfile && len(csmsRoots) == 1 {
+				return errCertificateInUse
+			}
+		}
+		return txn.Delete([]byte(installedCertificateKey(c.HashData)))
+	}
+	return errCertificateNotFound
+}
+
+// certificatePoolTX returns a pool with every installed certificate of the
+// given use, failing when there is none.
+func certificatePoolTX(txn *badger.Txn, use types.CertificateUse) (*x509.CertPool, error) {
+	installed, err := listInstalledCertificatesTX(txn, use)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range installed {
+		if !pool.AppendCertsFromPEM([]byte(c.Certificate)) {
+			return nil, fmt.Errorf("invalid %s", use)
+		}
+	}
+	if len(installed) == 0 {
+		return nil, fmt.Errorf("no %s installed", use)
+	}
+	return pool, nil
+}
+
+func certificatePool(use types.CertificateUse) (pool *x509.CertPool, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		pool, err = certificatePoolTX(txn, use)
+		return err
+	})
+	return pool, err
+}
+
+// migrateLegacyCertificatesTX moves the root certificates stored under the
+// single root_certificate and manufacturer_root_certificate keys into the
+// certificate store, within CertificateStoreMaxLength.
+func migrateLegacyCertificatesTX(txn *badger.Txn) error {
+	legacy := []struct {
+		key string
+		use types.CertificateUse
+	}{
+		{"root_certificate", types.CentralSystemRootCertificate},
+		{"manufacturer_root_certificate", types.ManufacturerRootCertificate},
+	}
+	for _, l := range legacy {
+		certificate, err := GetKeyValueTX(txn, l.key)
+		if err != nil {
+			return err
+		}
+		if certificate == "" {
+			continue
+		}
+		err = installCertificateTX(txn, l.use, certificate)
+		if errors.Is(err, errCertificateStoreFull) || errors.Is(err, errNotRootCertificate) {
+			// the legacy certificate stays where it was
+			appLogger.WithError(err).Error("Legacy ", l.use, " not moved to the certificate store")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(l.key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateCertificateStoreMaxLengthTX raises the CertificateStoreMaxLength of 1
+// set by older versions, which left no room for a ManufacturerRootCertificate
+// next to the CentralSystemRootCertificate. It runs once so that a length set
+// later on is kept.
+func migrateCertificateStoreMaxLengthTX(txn *badger.Txn) error {
+	const migratedKey = "certificate_store_max_length_migrated"
+	if migrated, err := GetKeyValueTX(txn, migratedKey); err != nil || migrated != "" {
+		return err
+	}
+	length, err := GetIntKeyTX(txn, "CertificateStoreMaxLength")
+	if err != nil {
+		return err
+	}
+	if length == 1 {
+		if err := txn.Set([]byte("CertificateStoreMaxLength"), []byte(strconv.Itoa(defaultCertificateStoreMaxLength))); err != nil {
+			return err
+		}
+	}
+	return txn.Set([]byte(migratedKey), []byte("true"))
+}
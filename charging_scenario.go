@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -13,9 +15,25 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (h *ChargePointHandler) RunRemoteScenario() error {
-	appLogger.Info("Starting/Resuming remote charging scenario")
-	statusNotification(core.ChargePointStatusCharging, 0)
+// activeScenarios holds the local id of the transaction each running scenario
+// simulates, by connector.
+var activeScenarios sync.Map
+
+// RunRemoteScenario simulates the EV charging on the connector for as long as
+// the transaction started with the local id localTxId is running.
+func (h *ChargePointHandler) RunRemoteScenario(connectorId, localTxId int) error {
+	if running, ok := activeScenarios.Load(connectorId); ok && running == localTxId {
+		return nil
+	}
+	activeScenarios.Store(connectorId, localTxId)
+	defer activeScenarios.CompareAndDelete(connectorId, localTxId)
+
+	appLogger.WithField("connector_id", connectorId).Info("Starting/Resuming remote charging scenario")
+	if connectorStatus(connectorId) == core.ChargePointStatusReserved {
+		// a reserved connector cannot start charging right away
+		setConnectorStatus(connectorId, core.ChargePointStatusPreparing, core.NoError)
+	}
+	setConnectorStatus(connectorId, scenarioStatus(connectorId, 1), core.NoError)
 
 	for {
 		meterValueIntervalInSeconds := MustGetIntKey("MeterValueSampleInterval")
@@ -24,31 +42,43 @@ func (h *ChargePointHandler) RunRemoteScenario() error {
 		}
 		time.Sleep(time.Duration(meterValueIntervalInSeconds) * time.Second)
 
+		// the active charging profiles cap what the EV is allowed to draw, and
+		// nothing is delivered to a deauthorized transaction
+		limitW, limitA := currentChargingLimits(connectorId)
+		if isTxDeauthorized(connectorId) {
+			limitW, limitA = 0, 0
+		}
+
 		db.Update(func(txn *badger.Txn) error {
-			IncrementKeyTX(txn, EnergyKey, fakeNumber(200, 1000))
-			IncrementKeyTX(txn, InstantaneousTemperatureKey, fakeNumber(20, 50))
-			IncrementKeyTX(txn, BatteryPercentageKey, fakeNumber(0, int(time.Now().Unix())%100))
+			key := func(k string) string { return meterValueKey(k, connectorId) }
+			maxEnergy := int(limitW * float64(meterValueIntervalInSeconds) / 3600)
+			if energy := min(fakeNumber(200, 1000), maxEnergy); energy > 0 {
+				IncrementKeyTX(txn, key(EnergyKey), energy)
+			}
+			IncrementKeyTX(txn, key(InstantaneousTemperatureKey), fakeNumber(20, 50))
+			IncrementKeyTX(txn, key(BatteryPercentageKey), fakeNumber(0, int(time.Now().Unix())%100))
 			p, v, c := generateFakePAV()
-			IncrementKeyTX(txn, InstantaneousPowerKey, p)
-			IncrementKeyTX(txn, InstantaneousVoltageKey, v)
-			IncrementKeyTX(txn, InstantaneousCurrentKey, c)
-			// ic, _ := GetIntKeyTX(txn, InstantaneousCurrentOfferedKey)
-			// IncrementKeyTX(txn, InstantaneousCurrentOfferedKey, int(int(math.Max(
-			// 	float64(ic),
-			// 	float64(c),
-			// ))))
+			IncrementKeyTX(txn, key(InstantaneousPowerKey), p)
+			IncrementKeyTX(txn, key(InstantaneousVoltageKey), v)
+			IncrementKeyTX(txn, key(InstantaneousCurrentKey), c)
+			CapKeyTX(txn, key(InstantaneousPowerKey), int(limitW))
+			CapKeyTX(txn, key(InstantaneousCurrentKey), int(limitA))
+			txn.Set([]byte(key(InstantaneousCurrentOfferedKey)), []byte(strconv.Itoa(int(limitA))))
 			return nil
 		})
 
-		if !isTxRunning() {
+		if !isTxRunning(connectorId) || currentLocalTxId(connectorId) != localTxId {
 			break
 		}
-		logFields := genMeterValues()
-		logFields["connector_id"] = currentTxConnectorId()
-		logFields["transaction_id"] = currentTxId()
+
+		setConnectorStatus(connectorId, scenarioStatus(connectorId, limitW), core.NoError)
+
+		logFields := genMeterValues(connectorId)
+		logFields["connector_id"] = connectorId
+		logFields["transaction_id"] = currentTxId(connectorId)
 		logFields["interval"] = meterValueIntervalInSeconds
 
-		if err := sendMeterValues(); err != nil {
+		if err := sendConnectorMeterValues(connectorId, types.ReadingContextSamplePeriodic); err != nil {
 			appLogger.WithError(err).
 				WithFields(logFields).
 				Error("Error sending Energy meter value")
@@ -59,67 +89,46 @@ func (h *ChargePointHandler) RunRemoteScenario() error {
 	return nil
 }
 
-func genMeterValues() logrus.Fields {
+// scenarioStatus returns the status of a connector charging with the power
+// limit, the EVSE suspends charging while no power is allowed or the idTag was
+// not accepted.
+func scenarioStatus(connectorId int, limitW float64) core.ChargePointStatus {
+	if limitW <= 0 || isTxDeauthorized(connectorId) {
+		return core.ChargePointStatusSuspendedEVSE
+	}
+	return core.ChargePointStatusCharging
+}
+
+func genMeterValues(connectorId int) logrus.Fields {
 	fields := logrus.Fields{}
 	db.View(func(txn *badger.Txn) error {
-		fields["energy_meter_value"] = MustGetIntKeyTX(txn, EnergyKey)
-		fields["instantaneous_power"] = MustGetIntKeyTX(txn, InstantaneousPowerKey)
-		fields["instantaneous_voltage"] = MustGetIntKeyTX(txn, InstantaneousVoltageKey)
-		fields["instantaneous_current"] = MustGetIntKeyTX(txn, InstantaneousCurrentKey)
-		// fields["instantaneous_current_offered"] = MustGetIntKeyTX(txn, InstantaneousCurrentOfferedKey)
-		fields["instantaneous_temperature"] = MustGetIntKeyTX(txn, InstantaneousTemperatureKey)
-		fields["battery_percentage"] = MustGetIntKeyTX(txn, BatteryPercentageKey)
+		key := func(k string) string { return meterValueKey(k, connectorId) }
+		fields["energy_meter_value"] = MustGetIntKeyTX(txn, key(EnergyKey))
+		fields["instantaneous_power"] = MustGetIntKeyTX(txn, key(InstantaneousPowerKey))
+		fields["instantaneous_voltage"] = MustGetIntKeyTX(txn, key(InstantaneousVoltageKey))
+		fields["instantaneous_current"] = MustGetIntKeyTX(txn, key(InstantaneousCurrentKey))
+		fields["instantaneous_current_offered"] = MustGetIntKeyTX(txn, key(InstantaneousCurrentOfferedKey))
+		fields["instantaneous_temperature"] = MustGetIntKeyTX(txn, key(InstantaneousTemperatureKey))
+		fields["battery_percentage"] = MustGetIntKeyTX(txn, key(BatteryPercentageKey))
 		return nil
 	})
 	return fields
 }
 
-func (h *ChargePointHandler) StopRemoteScenario() error {
-	statusNotification(core.ChargePointStatusFinishing, 0)
+func (h *ChargePointHandler) StopRemoteScenario(connectorId int) error {
+	setConnectorStatus(connectorId, core.ChargePointStatusFinishing, core.NoError)
 	time.Sleep(1 * time.Second)
-	statusNotification(core.ChargePointStatusAvailable, 0)
+	// a scheduled ChangeAvailability takes effect now
+	setConnectorStatus(connectorId, idleStatus(connectorId), core.NoError)
 	return nil
 }
 
-func bootNotification() error {
-	result, err := chargePoint.BootNotification(
-		faker.LastName(), faker.FirstName(),
-		func(request *core.BootNotificationRequest) {
-			request.ChargePointSerialNumber = faker.CCNumber()
-			request.MeterSerialNumber = faker.CCNumber()
-			request.MeterType = faker.CCNumber()
-			request.Iccid = faker.CCNumber()
-			request.FirmwareVersion = "v1.0.0"
-		})
-	if err != nil {
-		return err
-	}
-	if result.Status != core.RegistrationStatusAccepted {
-		appLogger.Println("BootNotification rejected", result.Status)
-	}
-	return db.Update(func(txn *badger.Txn) error {
-		i := fmt.Sprintf("%d", result.Interval)
-		return txn.Set([]byte("default_heartbeat_interval"), []byte(i))
-	})
-}
-
-func statusNotification(s core.ChargePointStatus, connectorId int) error {
-	if connectorId == 0 {
-		connectorId = currentTxConnectorId()
-	}
-	_, err := chargePoint.StatusNotification(
-		connectorId, core.NoError, s,
-		func(request *core.StatusNotificationRequest) {
-			request.Info = faker.MonthName()
-			request.Info = faker.MonthName()
-			request.VendorId = "vendor_" + faker.CCNumber()
-			request.Timestamp = types.NewDateTime(time.Now())
-		},
-	)
-	return err
+// meterValueKey returns the key of the connector's own meter register.
+func meterValueKey(key string, connectorId int) string {
+	return fmt.Sprintf("%s__%d", key, connectorId)
 }
 
-func sendMeterValues() error {
+func sendConnectorMeterValues(connectorId int, context types.ReadingContext) error {
 	sampledValues := []types.SampledValue{}
 
 	var rawData string
@@ -137,62 +146,68 @@ func sendMeterValues() error {
 
 	meterValuesSampledData := strings.Split(rawData, ",")
 
+	// triggered readings always include every configured measurand
+	sample := randomTrigger
+	if context == types.ReadingContextTrigger {
+		sample = func(fn func()) { fn() }
+	}
+
 	err := db.View(func(txn *badger.Txn) error {
 
 		for _, k := range meterValuesSampledData {
 			value := types.SampledValue{
 				Format:   types.ValueFormatRaw,
-				Context:  types.ReadingContextSamplePeriodic,
+				Context:  context,
 				Location: types.LocationOutlet,
 				Phase:    types.PhaseL1,
 			}
 
 			switch types.Measurand(k) {
 			case types.MeasurandEnergyActiveImportRegister:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, EnergyKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(EnergyKey, connectorId)))
 					value.Unit = types.UnitOfMeasureWh
 					value.Measurand = types.MeasurandEnergyActiveImportRegister
 				})
 
 			case types.MeasurandPowerActiveImport:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, InstantaneousPowerKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(InstantaneousPowerKey, connectorId)))
 					value.Unit = types.UnitOfMeasureW
 					value.Measurand = types.MeasurandPowerActiveImport
 				})
 
 			case types.MeasurandCurrentImport:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, InstantaneousCurrentKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(InstantaneousCurrentKey, connectorId)))
 					value.Unit = types.UnitOfMeasureA
 					value.Measurand = types.MeasurandCurrentImport
 				})
 
-			// case types.MeasurandCurrentOffered:
-			// 	randomTrigger(func() {
-			// 		value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, InstantaneousCurrentOfferedKey))
-			// 		value.Unit = types.UnitOfMeasureA
-			// 		value.Measurand = types.MeasurandCurrentOffered
-			// 	})
+			case types.MeasurandCurrentOffered:
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(InstantaneousCurrentOfferedKey, connectorId)))
+					value.Unit = types.UnitOfMeasureA
+					value.Measurand = types.MeasurandCurrentOffered
+				})
 
 			case types.MeasurandVoltage:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, InstantaneousVoltageKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(InstantaneousVoltageKey, connectorId)))
 					value.Unit = types.UnitOfMeasureV
 					value.Measurand = types.MeasurandVoltage
 				})
 
 			case types.MeasurandTemperature:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, InstantaneousTemperatureKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(InstantaneousTemperatureKey, connectorId)))
 					value.Unit = types.UnitOfMeasureCelsius
 					value.Measurand = types.MeasurandTemperature
 				})
 
 			case types.MeasurandSoC:
-				randomTrigger(func() {
-					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, BatteryPercentageKey))
+				sample(func() {
+					value.Value = fmt.Sprintf("%d", MustGetIntKeyTX(txn, meterValueKey(BatteryPercentageKey, connectorId)))
 					value.Unit = types.UnitOfMeasurePercent
 					value.Measurand = types.MeasurandSoC
 				})
@@ -215,21 +230,23 @@ func sendMeterValues() error {
 		return nil
 	}
 
-	cid := currentTxConnectorId()
-
-	_, err = chargePoint.MeterValues(
-		cid,
-		[]types.MeterValue{
-			{
-				Timestamp:    types.NewDateTime(time.Now()),
-				SampledValue: sampledValues,
-			},
-		},
-		func(request *core.MeterValuesRequest) {
-			currentTxId := currentTxId()
-			request.TransactionId = &currentTxId
+	meterValues := []types.MeterValue{
+		{
+			Timestamp:    types.NewDateTime(clockNow()),
+			SampledValue: sampledValues,
 		},
-	)
+	}
+
+	// meter values of a transaction are delivered through the transaction
+	// messages queue so that they survive going offline
+	if isTxRunning(connectorId) {
+		req := core.NewMeterValuesRequest(connectorId, meterValues)
+		txId := currentTxId(connectorId)
+		req.TransactionId = &txId
+		return queueTransactionMessage(connectorId, currentLocalTxId(connectorId), req, nil)
+	}
+
+	_, err = chargePoint.MeterValues(connectorId, meterValues)
 	return err
 }
 
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const (
+	nominalVoltage      = 230 // V
+	defaultNumberPhases = 3
+
+	// physical limits of the emulated charger, used when no profile applies
+	maxChargerPower   = 360_000 // W
+	maxChargerCurrent = 500     // A
+)
+
+// profileScheduleStart returns the start of the schedule of p that is
+// relevant at t. Relative profiles start with the transaction.
+func profileScheduleStart(p *types.ChargingProfile, t, txStart time.Time) (time.Time, bool) {
+	schedule := p.ChargingSchedule
+
+	switch p.ChargingProfileKind {
+	case types.ChargingProfileKindAbsolute:
+		if schedule.StartSchedule != nil {
+			return schedule.StartSchedule.Time, true
+		}
+		if p.ValidFrom != nil {
+			return p.ValidFrom.Time, true
+		}
+		return txStart, true
+
+	case types.ChargingProfileKindRelative:
+		return txStart, true
+
+	case types.ChargingProfileKindRecurring:
+		if schedule.StartSchedule == nil {
+			return time.Time{}, false
+		}
+		base := schedule.StartSchedule.Time
+		period := recurrencyPeriod(p.RecurrencyKind)
+		if t.Before(base) || period == 0 {
+			return base, true
+		}
+		n := t.Sub(base) / period
+		return base.Add(n * period), true
+	}
+	return time.Time{}, false
+}
+
+func recurrencyPeriod(kind types.RecurrencyKindType) time.Duration {
+	switch kind {
+	case types.RecurrencyKindDaily:
+		return 24 * time.Hour
+	case types.RecurrencyKindWeekly:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// profileLimitAt returns the limit p imposes at t, in the unit of its
+// schedule, and the number of phases it applies to.
+func profileLimitAt(p *types.ChargingProfile, t, txStart time.Time) (float64, int, bool) {
+	if p.ValidFrom != nil && t.Before(p.ValidFrom.Time) {
+		return 0, 0, false
+	}
+	if p.ValidTo != nil && !t.Before(p.ValidTo.Time) {
+		return 0, 0, false
+	}
+
+	start, ok := profileScheduleStart(p, t, txStart)
+	if !ok || t.Before(start) {
+		return 0, 0, false
+	}
+
+	schedule := p.ChargingSchedule
+	offset := int(t.Sub(start) / time.Second)
+	if schedule.Duration != nil && offset >= *schedule.Duration {
+		return 0, 0, false
+	}
+
+	var period *types.ChargingSchedulePeriod
+	for i := range schedule.ChargingSchedulePeriod {
+		sp := &schedule.ChargingSchedulePeriod[i]
+		if sp.StartPeriod > offset {
+			continue
+		}
+		if period == nil || sp.StartPeriod >= period.StartPeriod {
+			period = sp
+		}
+	}
+	if period == nil {
+		return 0, 0, false
+	}
+
+	phases := defaultNumberPhases
+	if period.NumberPhases != nil && *period.NumberPhases > 0 {
+		phases = *period.NumberPhases
+	}
+	return period.Limit, phases, true
+}
+
+// profileBoundaries returns the instants within [from, to) at which the limit
+// imposed by p may change.
+func profileBoundaries(p *types.ChargingProfile, from, to, txStart time.Time) []time.Time {
+	boundaries := []time.Time{}
+	add := func(t time.Time) {
+		if !t.Before(from) && t.Before(to) {
+			boundaries = append(boundaries, t)
+		}
+	}
+
+	if p.ValidFrom != nil {
+		add(p.ValidFrom.Time)
+	}
+	if p.ValidTo != nil {
+		add(p.ValidTo.Time)
+	}
+
+	addSchedule := func(start time.Time) {
+		add(start)
+		for _, sp := range p.ChargingSchedule.ChargingSchedulePeriod {
+			add(start.Add(time.Duration(sp.StartPeriod) * time.Second))
+		}
+		if d := p.ChargingSchedule.Duration; d != nil {
+			add(start.Add(time.Duration(*d) * time.Second))
+		}
+	}
+
+	start, ok := profileScheduleStart(p, from, txStart)
+	if !ok {
+		return boundaries
+	}
+	period := recurrencyPeriod(p.RecurrencyKind)
+	if p.ChargingProfileKind != types.ChargingProfileKindRecurring || period == 0 {
+		addSchedule(start)
+		return boundaries
+	}
+	for ; start.Before(to); start = start.Add(period) {
+		addSchedule(start)
+	}
+	return boundaries
+}
+
+func convertChargingRate(limit float64, from, to types.ChargingRateUnitType, phases int) float64 {
+	if from == to {
+		return limit
+	}
+	if to == types.ChargingRateUnitWatts {
+		return limit * nominalVoltage * float64(phases)
+	}
+	return limit / (nominalVoltage * float64(phases))
+}
+
+func maxChargingRate(unit types.ChargingRateUnitType) float64 {
+	if unit == types.ChargingRateUnitWatts {
+		return maxChargerPower
+	}
+	return maxChargerCurrent
+}
+
+// stackedLimitAt returns the limit of the highest stack level profile that is
+// active at t.
+func stackedLimitAt(profiles []StoredChargingProfile, t, txStart time.Time, unit types.ChargingRateUnitType) (float64, bool) {
+	sorted := make([]StoredChargingProfile, len(profiles))
+	copy(sorted, profiles)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Profile.StackLevel > sorted[j].Profile.StackLevel
+	})
+	for _, p := range sorted {
+		limit, phases, ok := profileLimitAt(p.Profile, t, txStart)
+		if !ok {
+			continue
+		}
+		return convertChargingRate(limit, p.Profile.ChargingSchedule.ChargingRateUnit, unit, phases), true
+	}
+	return 0, false
+}
+
+// compositeLimitAt combines the profiles applying to a connector at t: the
+// TxProfile (or TxDefaultProfile when there is none) capped by the
+// ChargePointMaxProfile and the charger's own physical limit. The
+// TxDefaultProfiles of the connector override the ones set on connector 0.
+func compositeLimitAt(profiles []StoredChargingProfile, connectorId int, t, txStart time.Time, unit types.ChargingRateUnitType) float64 {
+	var txProfiles, txDefaultProfiles, chargePointTxDefaultProfiles, maxProfiles []StoredChargingProfile
+	for _, p := range profiles {
+		switch p.Profile.ChargingProfilePurpose {
+		case types.ChargingProfilePurposeTxProfile:
+			if p.ConnectorId == connectorId {
+				txProfiles = append(txProfiles, p)
+			}
+		case types.ChargingProfilePurposeTxDefaultProfile:
+			if p.ConnectorId == connectorId {
+				txDefaultProfiles = append(txDefaultProfiles, p)
+			} else if p.ConnectorId == 0 {
+				chargePointTxDefaultProfiles = append(chargePointTxDefaultProfiles, p)
+			}
+		case types.ChargingProfilePurposeChargePointMaxProfile:
+			maxProfiles = append(maxProfiles, p)
+		}
+	}
+
+	limit := maxChargingRate(unit)
+	if connectorId > 0 {
+		txLimit, ok := stackedLimitAt(txProfiles, t, txStart, unit)
+		if !ok {
+			txLimit, ok = stackedLimitAt(txDefaultProfiles, t, txStart, unit)
+		}
+		if !ok {
+			txLimit, ok = stackedLimitAt(chargePointTxDefaultProfiles, t, txStart, unit)
+		}
+		if ok {
+			limit = math.Min(limit, txLimit)
+		}
+	}
+	if maxLimit, ok := stackedLimitAt(maxProfiles, t, txStart, unit); ok {
+		limit = math.Min(limit, maxLimit)
+	}
+	return limit
+}
+
+// compositeSchedule computes the schedule a connector will follow during the
+// next duration seconds starting at from.
+func compositeSchedule(profiles []StoredChargingProfile, connectorId int, from time.Time, duration int, unit types.ChargingRateUnitType, txStart time.Time) *types.ChargingSchedule {
+	to := from.Add(time.Duration(duration) * time.Second)
+
+	boundaries := []time.Time{from}
+	for _, p := range profiles {
+		boundaries = append(boundaries, profileBoundaries(p.Profile, from, to, txStart)...)
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return boundaries[i].Before(boundaries[j])
+	})
+
+	periods := []types.ChargingSchedulePeriod{}
+	for i, b := range boundaries {
+		if i > 0 && b.Equal(boundaries[i-1]) {
+			continue
+		}
+		limit := compositeLimitAt(profiles, connectorId, b, txStart, unit)
+		limit = math.Round(limit*10) / 10
+		if n := len(periods); n > 0 && periods[n-1].Limit == limit {
+			continue
+		}
+		startPeriod := int(b.Sub(from) / time.Second)
+		periods = append(periods, types.NewChargingSchedulePeriod(startPeriod, limit))
+	}
+
+	schedule := types.NewChargingSchedule(unit, periods...)
+	schedule.Duration = &duration
+	schedule.StartSchedule = types.NewDateTime(from)
+	return schedule
+}
+
+// currentChargingLimits returns the power (W) and current (A) a connector is
+// allowed to draw right now.
+func currentChargingLimits(connectorId int) (float64, float64) {
+	profiles, err := listChargingProfiles()
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading charging profiles")
+		return maxChargerPower, maxChargerCurrent
+	}
+	now := time.Now()
+	txStart := txStartedAt(connectorId, now)
+	power := compositeLimitAt(profiles, connectorId, now, txStart, types.ChargingRateUnitWatts)
+	current := compositeLimitAt(profiles, connectorId, now, txStart, types.ChargingRateUnitAmperes)
+	return power, current
+}
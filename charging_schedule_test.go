@@ -0,0 +1,246 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+var scheduleBase = time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+
+func testProfile(purpose types.ChargingProfilePurposeType, stackLevel int, unit types.ChargingRateUnitType, periods ...types.ChargingSchedulePeriod) *types.ChargingProfile {
+	schedule := types.NewChargingSchedule(unit, periods...)
+	schedule.StartSchedule = types.NewDateTime(scheduleBase)
+	return &types.ChargingProfile{
+		StackLevel:             stackLevel,
+		ChargingProfilePurpose: purpose,
+		ChargingProfileKind:    types.ChargingProfileKindAbsolute,
+		ChargingSchedule:       schedule,
+	}
+}
+
+func withDuration(p *types.ChargingProfile, seconds int) *types.ChargingProfile {
+	p.ChargingSchedule.Duration = &seconds
+	return p
+}
+
+func TestCompositeLimitAt(t *testing.T) {
+	txDefault := types.ChargingProfilePurposeTxDefaultProfile
+	txProfile := types.ChargingProfilePurposeTxProfile
+	maxProfile := types.ChargingProfilePurposeChargePointMaxProfile
+	amps := types.ChargingRateUnitAmperes
+	period := types.NewChargingSchedulePeriod
+
+	tests := []struct {
+		name     string
+		profiles []StoredChargingProfile
+		at       time.Duration
+		unit     types.ChargingRateUnitType
+		want     float64
+	}{
+		{
+			name: "no profile",
+			unit: amps,
+			want: maxChargerCurrent,
+		},
+		{
+			name: "highest stack level wins",
+			profiles: []StoredChargingProfile{
+				{1, testProfile(txDefault, 1, amps, period(0, 16))},
+				{1, testProfile(txDefault, 3, amps, period(0, 10))},
+				{1, testProfile(txDefault, 2, amps, period(0, 32))},
+			},
+			unit: amps,
+			want: 10,
+		},
+		{
+			name: "TxProfile over TxDefaultProfile",
+			profiles: []StoredChargingProfile{
+				{1, testProfile(txDefault, 5, amps, period(0, 10))},
+				{1, testProfile(txProfile, 0, amps, period(0, 20))},
+			},
+			unit: amps,
+			want: 20,
+		},
+		{
+			name: "connector TxDefaultProfile overrides connector 0",
+			profiles: []StoredChargingProfile{
+				{0, testProfile(txDefault, 5, amps, period(0, 10))},
+				{1, testProfile(txDefault, 1, amps, period(0, 24))},
+			},
+			unit: amps,
+			want: 24,
+		},
+		{
+			name: "connector 0 TxDefaultProfile once the connector's ended",
+			profiles: []StoredChargingProfile{
+				{0, testProfile(txDefault, 0, amps, period(0, 10))},
+				{1, withDuration(testProfile(txDefault, 1, amps, period(0, 24)), 3600)},
+			},
+			at:   2 * time.Hour,
+			unit: amps,
+			want: 10,
+		},
+		{
+			name: "other connectors' profiles ignored",
+			profiles: []StoredChargingProfile{
+				{2, testProfile(txDefault, 0, amps, period(0, 10))},
+				{2, testProfile(txProfile, 0, amps, period(0, 6))},
+			},
+			unit: amps,
+			want: maxChargerCurrent,
+		},
+		{
+			name: "capped by ChargePointMaxProfile",
+			profiles: []StoredChargingProfile{
+				{0, testProfile(maxProfile, 0, amps, period(0, 16))},
+				{1, testProfile(txProfile, 0, amps, period(0, 32))},
+			},
+			unit: amps,
+			want: 16,
+		},
+		{
+			name: "schedule periods",
+			profiles: []StoredChargingProfile{
+				{1, testProfile(txDefault, 0, amps, period(0, 6), period(1800, 12), period(3600, 18))},
+			},
+			at:   45 * time.Minute,
+			unit: amps,
+			want: 12,
+		},
+		{
+			name: "amperes limit in watts",
+			profiles: []StoredChargingProfile{
+				{1, testProfile(txProfile, 0, amps, period(0, 10))},
+			},
+			unit: types.ChargingRateUnitWatts,
+			want: 10 * nominalVoltage * defaultNumberPhases,
+		},
+		{
+			name: "watts limit in amperes",
+			profiles: []StoredChargingProfile{
+				{1, testProfile(txProfile, 0, types.ChargingRateUnitWatts, period(0, 6900))},
+			},
+			unit: amps,
+			want: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at := scheduleBase.Add(tt.at)
+			if got := compositeLimitAt(tt.profiles, 1, at, scheduleBase, tt.unit); got != tt.want {
+				t.Errorf("compositeLimitAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProfileLimitAt(t *testing.T) {
+	period := types.NewChargingSchedulePeriod
+	onePhase := 1
+
+	daily := testProfile(types.ChargingProfilePurposeTxDefaultProfile, 0, types.ChargingRateUnitAmperes,
+		period(0, 6), period(8*3600, 16))
+	daily.ChargingProfileKind = types.ChargingProfileKindRecurring
+	daily.RecurrencyKind = types.RecurrencyKindDaily
+
+	weekly := withDuration(testProfile(types.ChargingProfilePurposeTxDefaultProfile, 0, types.ChargingRateUnitAmperes,
+		period(0, 8)), 24*3600)
+	weekly.ChargingProfileKind = types.ChargingProfileKindRecurring
+	weekly.RecurrencyKind = types.RecurrencyKindWeekly
+
+	relative := testProfile(types.ChargingProfilePurposeTxProfile, 0, types.ChargingRateUnitAmperes,
+		period(0, 32), period(600, 10))
+	relative.ChargingProfileKind = types.ChargingProfileKindRelative
+	relative.ChargingSchedule.StartSchedule = nil
+
+	singlePhase := testProfile(types.ChargingProfilePurposeTxProfile, 0, types.ChargingRateUnitAmperes,
+		types.ChargingSchedulePeriod{StartPeriod: 0, Limit: 16, NumberPhases: &onePhase})
+
+	expired := testProfile(types.ChargingProfilePurposeTxProfile, 0, types.ChargingRateUnitAmperes, period(0, 16))
+	expired.ValidTo = types.NewDateTime(scheduleBase.Add(time.Hour))
+
+	txStart := scheduleBase.Add(30 * time.Minute)
+
+	tests := []struct {
+		name       string
+		profile    *types.ChargingProfile
+		at         time.Time
+		wantLimit  float64
+		wantPhases int
+		wantOk     bool
+	}{
+		{"before a recurring schedule", daily, scheduleBase.Add(-time.Minute), 0, 0, false},
+		{"daily first period", daily, scheduleBase.Add(time.Hour), 6, 3, true},
+		{"daily second period", daily, scheduleBase.Add(9 * time.Hour), 16, 3, true},
+		{"daily next day", daily, scheduleBase.Add(25 * time.Hour), 6, 3, true},
+		{"daily days later", daily, scheduleBase.Add(3*24*time.Hour + 10*time.Hour), 16, 3, true},
+		{"weekly within duration", weekly, scheduleBase.Add(7*24*time.Hour + time.Hour), 8, 3, true},
+		{"weekly after duration", weekly, scheduleBase.Add(2 * 24 * time.Hour), 0, 0, false},
+		{"relative before the transaction", relative, scheduleBase, 0, 0, false},
+		{"relative at the transaction start", relative, txStart, 32, 3, true},
+		{"relative after the transaction start", relative, txStart.Add(15 * time.Minute), 10, 3, true},
+		{"number of phases", singlePhase, scheduleBase, 16, 1, true},
+		{"valid", expired, scheduleBase.Add(59 * time.Minute), 16, 3, true},
+		{"past valid to", expired, scheduleBase.Add(time.Hour), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, phases, ok := profileLimitAt(tt.profile, tt.at, txStart)
+			if limit != tt.wantLimit || phases != tt.wantPhases || ok != tt.wantOk {
+				t.Errorf("profileLimitAt() = %v, %v, %v, want %v, %v, %v",
+					limit, phases, ok, tt.wantLimit, tt.wantPhases, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestConvertChargingRate(t *testing.T) {
+	amps := types.ChargingRateUnitAmperes
+	watts := types.ChargingRateUnitWatts
+
+	tests := []struct {
+		name     string
+		limit    float64
+		from, to types.ChargingRateUnitType
+		phases   int
+		want     float64
+	}{
+		{"same unit", 16, amps, amps, 3, 16},
+		{"amperes to watts, three phases", 16, amps, watts, 3, 11040},
+		{"amperes to watts, one phase", 16, amps, watts, 1, 3680},
+		{"watts to amperes, three phases", 11040, watts, amps, 3, 16},
+		{"watts to amperes, one phase", 3680, watts, amps, 1, 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convertChargingRate(tt.limit, tt.from, tt.to, tt.phases); got != tt.want {
+				t.Errorf("convertChargingRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompositeSchedule(t *testing.T) {
+	period := types.NewChargingSchedulePeriod
+	profiles := []StoredChargingProfile{
+		{0, testProfile(types.ChargingProfilePurposeTxDefaultProfile, 0, types.ChargingRateUnitAmperes, period(0, 10))},
+		{1, withDuration(testProfile(types.ChargingProfilePurposeTxDefaultProfile, 0, types.ChargingRateUnitAmperes,
+			period(0, 24), period(1800, 20)), 3600)},
+	}
+
+	schedule := compositeSchedule(profiles, 1, scheduleBase, 7200, types.ChargingRateUnitAmperes, scheduleBase)
+	want := []types.ChargingSchedulePeriod{period(0, 24), period(1800, 20), period(3600, 10)}
+	if len(schedule.ChargingSchedulePeriod) != len(want) {
+		t.Fatalf("compositeSchedule() periods = %v, want %v", schedule.ChargingSchedulePeriod, want)
+	}
+	for i, p := range schedule.ChargingSchedulePeriod {
+		if p.StartPeriod != want[i].StartPeriod || p.Limit != want[i].Limit {
+			t.Errorf("compositeSchedule() period %d = %v, want %v", i, p, want[i])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	chargePointCertificateKey = "charge_point_certificate"
+	chargePointPrivateKeyKey  = "charge_point_private_key"
+)
+
+// loadClientCertificateTX returns the ChargePointCertificate and its private
+// key, failing unless they match, are currently valid and were issued to this
+// charge point.
+func loadClientCertificateTX(txn *badger.Txn) (tls.Certificate, error) {
+	certPEM, err := GetKeyValueTX(txn, chargePointCertificateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := GetKeyValueTX(txn, chargePointPrivateKeyKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certPEM == "" || keyPEM == "" {
+		return tls.Certificate{}, errors.New("no charge point certificate installed")
+	}
+	return parseClientCertificate(certPEM, keyPEM)
+}
+
+func parseClientCertificate(certPEM, keyPEM string) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("charge point certificate is only valid from %s to %s",
+			leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	if leaf.Subject.CommonName != chargePointId {
+		return tls.Certificate{}, fmt.Errorf("charge point certificate was issued to %q", leaf.Subject.CommonName)
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+// installClientCertificate stores the certificate chain and private key found
+// in the given PEM blocks as the ChargePointCertificate.
+func installClientCertificate(data []byte) error {
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(block)...)
+		}
+	}
+	if _, err := parseClientCertificate(string(certPEM), string(keyPEM)); err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(chargePointCertificateKey), certPEM); err != nil {
+			return err
+		}
+		return txn.Set([]byte(chargePointPrivateKeyKey), keyPEM)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+// clockAdjustmentThreshold is how far the clock must be off before it is
+// adjusted, smaller differences are network latency
+const clockAdjustmentThreshold = 2 * time.Second
+
+// clockOffset is what the central system time is ahead of the local time, in
+// nanoseconds.
+var clockOffset atomic.Int64
+
+// clockNow returns the time of the charge point, following the central system
+// time, to be used for the timestamps sent to the central system.
+func clockNow() time.Time {
+	return time.Now().Add(time.Duration(clockOffset.Load()))
+}
+
+// syncClock adjusts the clock to the currentTime the central system returned
+// in a response to a request sent at sentAt, assuming the response took half
+// the round trip. Setting the clock is reported as a security event.
+func syncClock(currentTime *types.DateTime, sentAt time.Time) {
+	if currentTime == nil || currentTime.IsZero() {
+		return
+	}
+	receivedAt := time.Now()
+	localTime := sentAt.Add(receivedAt.Sub(sentAt) / 2)
+	offset := currentTime.Time.Sub(localTime)
+
+	previous := time.Duration(clockOffset.Load())
+	if (offset - previous).Abs() < clockAdjustmentThreshold {
+		return
+	}
+	clockOffset.Store(int64(offset))
+	appLogger.WithField("offset", offset).Infoln("Clock set to the central system time")
+	sendSecurityEvent("SettingSystemTime", fmt.Sprintf("clock adjusted by %s", offset-previous))
+}
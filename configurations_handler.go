@@ -2,11 +2,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
 )
 
 func (handler *ChargePointHandler) OnChangeConfiguration(request *core.ChangeConfigurationRequest) (confirmation *core.ChangeConfigurationConfirmation, err error) {
@@ -18,8 +20,13 @@ func (handler *ChargePointHandler) OnChangeConfiguration(request *core.ChangeCon
 	}
 
 	requiresReboot := false
+	previous, _ := GetKeyValue(key)
 
 	switch key {
+	case "HeartbeatInterval", "WebSocketPingInterval":
+		if v, err := strconv.Atoi(value); err != nil || v < 0 {
+			return core.NewChangeConfigurationConfirmation(core.ConfigurationStatusRejected), nil
+		}
 	case "SecurityProfile":
 		v, _ := strconv.Atoi(value)
 		if err := db.View(func(txn *badger.Txn) error {
@@ -39,18 +46,23 @@ func (handler *ChargePointHandler) OnChangeConfiguration(request *core.ChangeCon
 				}
 
 				if v == BasicSecurityWithTLSProfile {
-					rootCert, err := GetKeyValueTX(txn, "root_certificate")
-					if err != nil {
-						return err
-					}
-					if rootCert == "" {
-						return errors.New("this profile requires a root certificate")
+					if _, err := certificatePoolTX(txn, types.CentralSystemRootCertificate); err != nil {
+						return fmt.Errorf("this profile requires a root certificate: %w", err)
 					}
 					requiresReboot = false
 				} else {
 					requiresReboot = true
 				}
 
+			case TLSWithClientSideCertificatesProfile:
+				if _, err := certificatePoolTX(txn, types.CentralSystemRootCertificate); err != nil {
+					return fmt.Errorf("this profile requires a root certificate: %w", err)
+				}
+				if _, err := loadClientCertificateTX(txn); err != nil {
+					return fmt.Errorf("this profile requires a valid client certificate: %w", err)
+				}
+				requiresReboot = true
+
 			default:
 				return errors.New("unknown security profile")
 			}
@@ -74,6 +86,19 @@ func (handler *ChargePointHandler) OnChangeConfiguration(request *core.ChangeCon
 		return core.NewChangeConfigurationConfirmation(core.ConfigurationStatusRejected), err
 	}
 
+	if key == "HeartbeatInterval" {
+		resetHeartbeat()
+	}
+
+	// the websocket client only applies its timeouts when connecting
+	if key == "WebSocketPingInterval" && value != previous {
+		go restartConnection()
+	}
+
+	if key == "SecurityProfile" || key == "AuthorizationKey" {
+		sendSecurityEvent("ReconfigurationOfSecurityParameters", key)
+	}
+
 	if requiresReboot {
 		appLogger.Info("Security profile change requires reboot")
 
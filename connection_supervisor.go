@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ws"
+)
+
+type ConnectionState string
+
+const (
+	ConnectionStateDisconnected ConnectionState = "Disconnected"
+	ConnectionStateConnecting   ConnectionState = "Connecting"
+	ConnectionStateConnected    ConnectionState = "Connected"
+	ConnectionStateReconnecting ConnectionState = "Reconnecting"
+
+	connectionLogSize = 100
+
+	// pingsDisabledPeriod stands for never when WebSocketPingInterval is 0,
+	// the connection is then only considered dead once the socket fails
+	pingsDisabledPeriod = 365 * 24 * time.Hour
+
+	// pingRestartDelay lets the ChangeConfiguration confirmation reach the
+	// central system before the connection is restarted
+	pingRestartDelay = 1500 * time.Millisecond
+)
+
+// ConnectionStatus is the state of the connection to the central system as
+// reported by the control server.
+type ConnectionStatus struct {
+	State     ConnectionState `json:"state"`
+	Since     time.Time       `json:"since"`
+	Attempt   int             `json:"attempt,omitempty"`
+	LastError string          `json:"lastError,omitempty"`
+}
+
+var (
+	connectionMu     sync.Mutex
+	connectionStatus = ConnectionStatus{State: ConnectionStateDisconnected, Since: time.Now()}
+	connectionLog    = newLineRing(connectionLogSize)
+
+	// autoReconnect is cleared when the charge point is stopped on purpose,
+	// so that the supervisor gives up reconnecting
+	autoReconnect atomic.Bool
+	reconnecting  atomic.Bool
+)
+
+// setConnectionState records a transition of the connection state, err is the
+// cause of losing the connection or of a failed attempt.
+func setConnectionState(state ConnectionState, attempt int, err error) {
+	connectionMu.Lock()
+	previous := connectionStatus.State
+	connectionStatus = ConnectionStatus{State: state, Since: time.Now(), Attempt: attempt}
+	if err != nil {
+		connectionStatus.LastError = err.Error()
+	}
+	status := connectionStatus
+	connectionMu.Unlock()
+
+	line := string(previous) + " -> " + string(state)
+	if status.LastError != "" {
+		line += ": " + status.LastError
+	}
+	connectionLog.Add(status.Since, line)
+	appLogger.WithField("attempt", attempt).WithError(err).Infoln("Connection state changed from", previous, "to", state)
+}
+
+func currentConnectionStatus() ConnectionStatus {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	return connectionStatus
+}
+
+// wsTimeoutConfig returns the websocket timeouts, the websocket client
+// reconnects on its own with the RetryBackOff* configuration. It pings the
+// central system every WebSocketPingInterval seconds and considers the
+// connection dead, reconnecting, when no pong arrived within PongWait.
+func wsTimeoutConfig() ws.ClientTimeoutConfig {
+	config := ws.NewClientTimeoutConfig()
+	config.PingPeriod = pingsDisabledPeriod
+	if interval := MustGetIntKey("WebSocketPingInterval"); interval > 0 {
+		config.PingPeriod = time.Duration(interval) * time.Second
+	}
+	// the pong is expected before the next ping would be sent, with the same
+	// margin as the websocket client defaults
+	config.PongWait = config.PingPeriod * 10 / 9
+	config.RetryBackOffWaitMinimum = time.Duration(MustGetIntKey("RetryBackOffWaitMinimum")) * time.Second
+	config.RetryBackOffRandomRange = MustGetIntKey("RetryBackOffRandomRange")
+	config.RetryBackOffRepeatTimes = MustGetIntKey("RetryBackOffRepeatTimes")
+	return config
+}
+
+// reconnectDelay returns how long to wait before the attempt: starting at
+// RetryBackOffWaitMinimum, the delay doubles for RetryBackOffRepeatTimes
+// attempts and stays capped afterwards, with up to RetryBackOffRandomRange
+// seconds of jitter.
+func reconnectDelay(attempt int) time.Duration {
+	delay := time.Duration(MustGetIntKey("RetryBackOffWaitMinimum")) * time.Second
+	delay <<= min(attempt, max(MustGetIntKey("RetryBackOffRepeatTimes"), 0))
+	if randomRange := MustGetIntKey("RetryBackOffRandomRange"); randomRange > 0 {
+		delay += time.Duration(rand.Intn(randomRange+1)) * time.Second
+	}
+	return delay
+}
+
+// onConnectionLost is called when the websocket dropped without being stopped
+// on purpose, the websocket client is reconnecting by then.
+func onConnectionLost(err error) {
+	select {
+	case <-stopC:
+		setConnectionState(ConnectionStateDisconnected, 0, nil)
+	default:
+		setConnectionState(ConnectionStateReconnecting, 0, err)
+	}
+}
+
+// onReconnected resumes the charge point operation once the websocket client
+// reconnected on its own.
+func onReconnected() {
+	setConnectionState(ConnectionStateConnected, 0, nil)
+	go resumeCharger()
+}
+
+// resumeCharger catches up with the central system after the connection was
+// restored: a BootNotification is only sent again when the charge point
+// wasn't registered, then the statuses and queued messages missed while
+// offline are sent.
+func resumeCharger() {
+	if !isRegistered() {
+		if err := bootNotification(); err != nil {
+			appLogger.WithError(err).Error("Error sending BootNotification")
+		}
+		return
+	}
+	reportConnectorStatuses()
+	flushSecurityEvents()
+	flushTransactionMessages()
+}
+
+// restartConnection connects to the central system again so that a new
+// websocket configuration takes effect, the registration is kept. The old
+// client is stopped even when it is not connected, it may be in its own
+// reconnection loop.
+func restartConnection() {
+	time.Sleep(pingRestartDelay)
+	closeStopC()
+	chargePoint.Stop()
+	setConnectionState(ConnectionStateDisconnected, 0, nil)
+	if err := bootCharger(); err != nil {
+		appLogger.WithError(err).Error("Error restarting the connection")
+		go superviseConnection(err)
+	}
+}
+
+// superviseConnection keeps starting the charge point after a connection
+// could not be established, backing off between attempts, until it is
+// connected or stopped on purpose.
+func superviseConnection(cause error) {
+	if !reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer reconnecting.Store(false)
+	autoReconnect.Store(true)
+
+	for attempt := 1; ; attempt++ {
+		setConnectionState(ConnectionStateReconnecting, attempt, cause)
+		time.Sleep(reconnectDelay(attempt - 1))
+		if !autoReconnect.Load() || chargePoint.IsConnected() {
+			return
+		}
+		if cause = bootCharger(); cause == nil {
+			return
+		}
+	}
+}
+
+// resumeScenarios resumes charging on the connectors whose transaction was
+// running before the charge point restarted.
+func resumeScenarios() {
+	for id := 1; id <= numberOfConnectors(); id++ {
+		if isTxRunning(id) {
+			go handler.RunRemoteScenario(id, currentLocalTxId(id))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/go-faker/faker/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+var (
+	errIllegalTransition = errors.New("illegal status transition")
+
+	// connectorStatusMu serializes the status transitions so that concurrent
+	// changes cannot both pass the transition check.
+	connectorStatusMu sync.Mutex
+
+	// connectorTransitions lists the statuses a connector may move to from
+	// each status, following the OCPP 1.6 StatusNotification transition table.
+	connectorTransitions = map[core.ChargePointStatus][]core.ChargePointStatus{
+		core.ChargePointStatusAvailable: {
+			core.ChargePointStatusPreparing, core.ChargePointStatusCharging,
+			core.ChargePointStatusSuspendedEV, core.ChargePointStatusSuspendedEVSE,
+			core.ChargePointStatusReserved, core.ChargePointStatusUnavailable,
+			core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusPreparing: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusCharging,
+			core.ChargePointStatusSuspendedEV, core.ChargePointStatusSuspendedEVSE,
+			core.ChargePointStatusFinishing, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusCharging: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusSuspendedEV,
+			core.ChargePointStatusSuspendedEVSE, core.ChargePointStatusFinishing,
+			core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusSuspendedEV: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusCharging,
+			core.ChargePointStatusSuspendedEVSE, core.ChargePointStatusFinishing,
+			core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusSuspendedEVSE: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusCharging,
+			core.ChargePointStatusSuspendedEV, core.ChargePointStatusFinishing,
+			core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusFinishing: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusPreparing,
+			core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusReserved: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusPreparing,
+			core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusUnavailable: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusPreparing,
+			core.ChargePointStatusCharging, core.ChargePointStatusSuspendedEV,
+			core.ChargePointStatusSuspendedEVSE, core.ChargePointStatusFaulted,
+		},
+		core.ChargePointStatusFaulted: {
+			core.ChargePointStatusAvailable, core.ChargePointStatusPreparing,
+			core.ChargePointStatusCharging, core.ChargePointStatusSuspendedEV,
+			core.ChargePointStatusSuspendedEVSE, core.ChargePointStatusFinishing,
+			core.ChargePointStatusReserved, core.ChargePointStatusUnavailable,
+		},
+	}
+
+	// chargePointTransitions is the reduced state machine of connector 0, the
+	// charge point as a whole.
+	chargePointTransitions = map[core.ChargePointStatus][]core.ChargePointStatus{
+		core.ChargePointStatusAvailable:   {core.ChargePointStatusUnavailable, core.ChargePointStatusFaulted},
+		core.ChargePointStatusUnavailable: {core.ChargePointStatusAvailable, core.ChargePointStatusFaulted},
+		core.ChargePointStatusFaulted:     {core.ChargePointStatusAvailable, core.ChargePointStatusUnavailable},
+	}
+)
+
+func connectorStatusKey(connectorId int) string {
+	return fmt.Sprintf("connector_status__%d", connectorId)
+}
+
+func connectorErrorCodeKey(connectorId int) string {
+	return fmt.Sprintf("connector_error_code__%d", connectorId)
+}
+
+// connectorStatus returns the current status of the connector.
+func connectorStatus(connectorId int) core.ChargePointStatus {
+	status, _ := GetKeyValue(connectorStatusKey(connectorId))
+	if status == "" {
+		return core.ChargePointStatusAvailable
+	}
+	return core.ChargePointStatus(status)
+}
+
+// connectorErrorCode returns the error code reported with the current status
+// of the connector.
+func connectorErrorCode(connectorId int) core.ChargePointErrorCode {
+	errorCode, _ := GetKeyValue(connectorErrorCodeKey(connectorId))
+	if errorCode == "" {
+		return core.NoError
+	}
+	return core.ChargePointErrorCode(errorCode)
+}
+
+func isLegalTransition(connectorId int, from, to core.ChargePointStatus) bool {
+	transitions := connectorTransitions
+	if connectorId == 0 {
+		transitions = chargePointTransitions
+	}
+	if _, ok := transitions[to]; !ok {
+		return false
+	}
+	next, ok := transitions[from]
+	if !ok {
+		// the current status is unknown to this state machine, e.g. it was
+		// stored by an older version, any known status may follow it
+		return true
+	}
+	for _, s := range next {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setConnectorStatus moves the connector, connector 0 being the charge point
+// as a whole, to the status and reports it with a StatusNotification. Setting
+// the current status and error code again is a no-op, Faulted requires an
+// error code.
+func setConnectorStatus(connectorId int, status core.ChargePointStatus, errorCode core.ChargePointErrorCode) error {
+	if errorCode == "" {
+		errorCode = core.NoError
+	}
+	if status == core.ChargePointStatusFaulted && errorCode == core.NoError {
+		return fmt.Errorf("%s requires an error code", status)
+	}
+	if connectorId < 0 || connectorId > numberOfConnectors() {
+		return fmt.Errorf("unknown connector %d", connectorId)
+	}
+
+	connectorStatusMu.Lock()
+	current := connectorStatus(connectorId)
+	currentErrorCode := connectorErrorCode(connectorId)
+	if current == status && currentErrorCode == errorCode {
+		connectorStatusMu.Unlock()
+		return nil
+	}
+	if current != status && !isLegalTransition(connectorId, current, status) {
+		connectorStatusMu.Unlock()
+		err := fmt.Errorf("%w: connector %d from %s to %s", errIllegalTransition, connectorId, current, status)
+		appLogger.WithError(err).Warn("Status not changed")
+		return err
+	}
+	err := db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(connectorStatusKey(connectorId)), []byte(status)); err != nil {
+			return err
+		}
+		return txn.Set([]byte(connectorErrorCodeKey(connectorId)), []byte(errorCode))
+	})
+	connectorStatusMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	appLogger.
+		WithField("connector_id", connectorId).
+		WithField("error_code", errorCode).
+		Infoln("Status changed from", current, "to", status)
+	return statusNotification(connectorId, status, errorCode)
+}
+
+// sendConnectorStatus reports the current status of the connector.
+func sendConnectorStatus(connectorId int) error {
+	return statusNotification(connectorId, connectorStatus(connectorId), connectorErrorCode(connectorId))
+}
+
+func statusNotification(connectorId int, status core.ChargePointStatus, errorCode core.ChargePointErrorCode) error {
+	_, err := chargePoint.StatusNotification(
+		connectorId, errorCode, status,
+		func(request *core.StatusNotificationRequest) {
+			request.Info = faker.MonthName()
+			request.VendorId = "vendor_" + faker.CCNumber()
+			request.Timestamp = types.NewDateTime(clockNow())
+		},
+	)
+	return err
+}
+
+// reportConnectorStatuses sends the status of the charge point and of every
+// connector, as expected after a BootNotification.
+func reportConnectorStatuses() {
+	for id := 0; id <= numberOfConnectors(); id++ {
+		if err := sendConnectorStatus(id); err != nil {
+			appLogger.WithError(err).Error("Error sending StatusNotification for connector ", id)
+		}
+	}
+}
@@ -15,6 +15,7 @@ const (
 	NoSecurityProfile = iota
 	BasicSecurityProfile
 	BasicSecurityWithTLSProfile
+	TLSWithClientSideCertificatesProfile
 )
 
 var (
@@ -64,5 +65,8 @@ var (
 		"AdditionalRootCertificateCheck":          {},
 		"CertificateStoreMaxLength":               {},
 		"AuthorizationKey":                        {},
+		"RetryBackOffWaitMinimum":                 {},
+		"RetryBackOffRandomRange":                 {},
+		"RetryBackOffRepeatTimes":                 {},
 	}
 )
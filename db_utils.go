@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"strconv"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/jedib0t/go-pretty/v6/table"
 )
 
 func KeyExists(key string) (bool, error) {
@@ -53,6 +58,12 @@ func MustGetIntKey(key string) int {
 	return val
 }
 
+func MustGetBoolKey(key string) bool {
+	val, _ := GetKeyValue(key)
+	b, _ := strconv.ParseBool(val)
+	return b
+}
+
 func GetIntKey(key string) (int, error) {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
@@ -121,3 +132,88 @@ func SetIfNotExistsTX(txn *badger.Txn, key, value string) error {
 	}
 	return txn.Set([]byte(key), []byte(value))
 }
+
+// CapKeyTX lowers the integer stored at key to limit if it exceeds it.
+func CapKeyTX(txn *badger.Txn, key string, limit int) error {
+	i, err := GetIntKeyTX(txn, key)
+	if err != nil {
+		return err
+	}
+	if i <= limit {
+		return nil
+	}
+	return txn.Set([]byte(key), []byte(strconv.Itoa(limit)))
+}
+
+// FirstQueuedValue returns the key and the JSON decoded value of the first key
+// with the prefix. Values that fail to decode are dropped so that they don't
+// hold up the ones queued after them.
+func FirstQueuedValue[T any](prefix string) (key []byte, value T, ok bool) {
+	for {
+		var data []byte
+		key = nil
+		if err := db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			it.Rewind()
+			if !it.Valid() {
+				return nil
+			}
+			key = it.Item().KeyCopy(nil)
+			var err error
+			data, err = it.Item().ValueCopy(nil)
+			return err
+		}); err != nil {
+			appLogger.WithError(err).Error("Error reading queue ", prefix)
+			return nil, value, false
+		}
+		if key == nil {
+			return nil, value, false
+		}
+
+		var v T
+		err := json.Unmarshal(data, &v)
+		if err == nil {
+			return key, v, true
+		}
+		appLogger.WithError(err).Error("Dropping invalid queued value ", string(key))
+		if err := db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		}); err != nil {
+			appLogger.WithError(err).Error("Error dropping queued value ", string(key))
+			return nil, value, false
+		}
+	}
+}
+
+// DumpDB renders every key of the database as a table, the values of the
+// hidden keys are left out.
+func DumpDB(w io.Writer, hidden ...string) {
+	t := table.NewWriter()
+	t.SetOutputMirror(w)
+	t.AppendHeader(table.Row{"Key", "Value", "LTT"})
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			v, _ := item.ValueCopy(nil)
+			if slices.Contains(hidden, string(k)) {
+				v = []byte(redactedValue)
+			}
+			if len(v) > 150 {
+				v = []byte(fmt.Sprintf("%s...", v[:150]))
+			}
+			t.AppendRows([]table.Row{
+				{string(k), string(v), item.ExpiresAt()},
+			})
+		}
+		return nil
+	})
+	t.Render()
+}
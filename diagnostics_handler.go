@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/firmware"
+)
+
+const redactedValue = "<redacted>"
+
+var (
+	diagnosticsUploadInProgress atomic.Bool
+
+	// secretKeys are the database keys and configuration keys whose values
+	// never leave the charge point
+	secretKeys = []string{"AuthorizationKey", chargePointPrivateKeyKey, chargePointPendingPrivateKeyKey}
+
+	// urlCredentials matches the user info of a URL, such as the basic auth
+	// credentials of the central system URL
+	urlCredentials = regexp.MustCompile(`://[^/\s@"]+@`)
+)
+
+func (handler *ChargePointHandler) OnGetDiagnostics(request *firmware.GetDiagnosticsRequest) (confirmation *firmware.GetDiagnosticsConfirmation, err error) {
+	appLogger.Println("OnGetDiagnostics", request.Location, request.StartTime, request.StopTime)
+
+	confirmation = firmware.NewGetDiagnosticsConfirmation()
+	if !diagnosticsUploadInProgress.CompareAndSwap(false, true) {
+		appLogger.Println("Diagnostics upload already in progress, ignoring request")
+		return confirmation, nil
+	}
+
+	var from, to time.Time
+	if request.StartTime != nil {
+		from = request.StartTime.Time
+	}
+	if request.StopTime != nil {
+		to = request.StopTime.Time
+	}
+	retries, retryInterval := transferRetries(request.Retries, request.RetryInterval)
+
+	fileName := fmt.Sprintf("diagnostics_%s_%s.zip", chargePointId, time.Now().Format("20060102T150405Z"))
+	confirmation.FileName = fileName
+
+	afterConfirmation(func() {
+		defer diagnosticsUploadInProgress.Store(false)
+		uploadDiagnostics(request.Location, fileName, from, to, retries, retryInterval)
+	})
+
+	return confirmation, nil
+}
+
+func uploadDiagnostics(location, fileName string, from, to time.Time, retries int, retryInterval time.Duration) {
+	archive, err := buildDiagnosticsArchive(from, to)
+	if err != nil {
+		appLogger.WithError(err).Error("Error building diagnostics archive")
+		setDiagnosticsStatus(firmware.DiagnosticsStatusUploadFailed)
+		return
+	}
+
+	if err := withRetries("Diagnostics upload", location, retries, retryInterval, func() error {
+		setDiagnosticsStatus(firmware.DiagnosticsStatusUploading)
+		return uploadFile(location, fileName, archive)
+	}); err != nil {
+		setDiagnosticsStatus(firmware.DiagnosticsStatusUploadFailed)
+		return
+	}
+	appLogger.Infoln("Diagnostics uploaded", fileName)
+	setDiagnosticsStatus(firmware.DiagnosticsStatusUploaded)
+}
+
+// buildDiagnosticsArchive bundles the logs and exchanged OCPP messages within
+// [from, to] together with a dump of the database, without the secrets they
+// contain as the archive is uploaded wherever the central system asks.
+func buildDiagnosticsArchive(from, to time.Time) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+
+	files := []struct {
+		name string
+		data func() []byte
+	}{
+		{"emulator.log", func() []byte { return joinLines(redactLines(diagnosticsLog.Between(from, to))) }},
+		{"security.log", func() []byte { return joinLines(redactLines(securityLog.Between(from, to))) }},
+		{"message_journal.log", func() []byte { return joinLines(redactLines(messageJournal.Between(from, to))) }},
+		{"db_dump.txt", func() []byte {
+			dump := &bytes.Buffer{}
+			DumpDB(dump, secretKeys...)
+			return urlCredentials.ReplaceAll(dump.Bytes(), []byte("://"+redactedValue+"@"))
+		}},
+	}
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(f.data()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// redactLines removes the URL credentials from the lines, and the values of the
+// secret configuration keys from the OCPP messages of the journal.
+func redactLines(lines []logLine) []logLine {
+	redacted := make([]logLine, len(lines))
+	for i, l := range lines {
+		line := urlCredentials.ReplaceAllString(l.Line, "://"+redactedValue+"@")
+		if direction, message, ok := strings.Cut(line, " "); ok && (direction == "->" || direction == "<-") {
+			line = direction + " " + redactMessage(message)
+		}
+		redacted[i] = logLine{Time: l.Time, Line: line}
+	}
+	return redacted
+}
+
+// redactMessage replaces the value of the secret keys wherever the message
+// holds a {"key": ..., "value": ...} pair, as in ChangeConfiguration requests
+// and GetConfiguration confirmations.
+func redactMessage(message string) string {
+	d := json.NewDecoder(strings.NewReader(message))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil || !redactValue(v) {
+		return message
+	}
+	data := &bytes.Buffer{}
+	e := json.NewEncoder(data)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return message
+	}
+	return strings.TrimSuffix(data.String(), "\n")
+}
+
+func redactValue(v any) bool {
+	redacted := false
+	switch v := v.(type) {
+	case []any:
+		for _, e := range v {
+			redacted = redactValue(e) || redacted
+		}
+	case map[string]any:
+		if key, ok := v["key"].(string); ok && slices.Contains(secretKeys, key) {
+			if _, ok := v["value"]; ok {
+				v["value"] = redactedValue
+				redacted = true
+			}
+		}
+		for _, e := range v {
+			redacted = redactValue(e) || redacted
+		}
+	}
+	return redacted
+}
+
+// setDiagnosticsStatus reports a diagnostics status and stores the one
+// currentDiagnosticsStatus returns.
+func setDiagnosticsStatus(status firmware.DiagnosticsStatus) {
+	if _, err := chargePoint.DiagnosticsStatusNotification(status); err != nil {
+		appLogger.WithError(err).Error("Error sending DiagnosticsStatusNotification ", status)
+	} else {
+		appLogger.Println("DiagnosticsStatusNotification", status)
+	}
+
+	if status != firmware.DiagnosticsStatusUploading {
+		status = firmware.DiagnosticsStatusIdle
+	}
+	db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("diagnostics_status"), []byte(status))
+	})
+}
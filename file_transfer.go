@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileTransferTimeout = 2 * time.Minute
+
+	// defaultRetryInterval is the wait between transfer attempts when the
+	// central system doesn't give one
+	defaultRetryInterval = 30 * time.Second
+)
+
+var (
+	pasvAddrRegex = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+	errPermissionDenied = errors.New("permission denied")
+	errTransferCanceled = errors.New("transfer canceled")
+)
+
+// transferRetries returns the attempts and the interval between them requested
+// for a transfer, a single attempt when the central system gives no retries.
+func transferRetries(retries, retryInterval *int) (int, time.Duration) {
+	attempts, interval := 1, defaultRetryInterval
+	if retries != nil && *retries > 0 {
+		attempts = *retries
+	}
+	if retryInterval != nil && *retryInterval > 0 {
+		interval = time.Duration(*retryInterval) * time.Second
+	}
+	return attempts, interval
+}
+
+// withRetries makes up to attempts calls of fn to transfer the file at
+// location, waiting interval after each failure, and returns the last error.
+// A permission denied or a canceled transfer is not retried.
+func withRetries(what, location string, attempts int, interval time.Duration, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil || errors.Is(err, errPermissionDenied) || errors.Is(err, errTransferCanceled) {
+			return err
+		}
+		appLogger.WithError(err).
+			WithField("attempt", attempt).
+			WithField("location", location).
+			Error(what, " failed")
+		if attempt < attempts {
+			time.Sleep(interval)
+		}
+	}
+	return err
+}
+
+// downloadFile fetches the file at location over HTTP(S) or FTP.
+func downloadFile(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: fileTransferTimeout}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download failed with status %s", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+
+	case "ftp":
+		return ftpTransfer(u, "RETR", nil)
+	}
+	return nil, fmt.Errorf("unsupported file transfer protocol %q", u.Scheme)
+}
+
+// uploadFile sends data as fileName to location over HTTP(S) or FTP. HTTP
+// locations ending with a slash receive the file name appended and a POST,
+// any other HTTP location a PUT.
+func uploadFile(location, fileName string, data []byte) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		method := http.MethodPut
+		if strings.HasSuffix(u.Path, "/") {
+			method = http.MethodPost
+			u.Path += fileName
+		}
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		client := &http.Client{Timeout: fileTransferTimeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: upload failed with status %s", errPermissionDenied, resp.Status)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("upload failed with status %s", resp.Status)
+		}
+		return nil
+
+	case "ftp":
+		if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+			u.Path = path.Join(u.Path, fileName)
+		}
+		_, err := ftpTransfer(u, "STOR", data)
+		return err
+	}
+	return fmt.Errorf("unsupported file transfer protocol %q", u.Scheme)
+}
+
+// ftpTransfer runs a single passive mode RETR or STOR against the FTP server
+// of u, data is only used by STOR.
+func ftpTransfer(u *url.URL, command string, data []byte) ([]byte, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, fileTransferTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(fileTransferTimeout))
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return nil, err
+	}
+
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	if err := c.PrintfLine("USER %s", user); err != nil {
+		return nil, err
+	}
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 230:
+	case 331:
+		if err := c.PrintfLine("PASS %s", password); err != nil {
+			return nil, err
+		}
+		if code, msg, err := c.ReadResponse(230); err != nil {
+			if code == 530 {
+				return nil, fmt.Errorf("%w: ftp login failed: %s", errPermissionDenied, msg)
+			}
+			return nil, err
+		}
+	case 530:
+		return nil, fmt.Errorf("%w: ftp login failed: %s", errPermissionDenied, msg)
+	default:
+		return nil, fmt.Errorf("ftp login failed: %d %s", code, msg)
+	}
+
+	if err := c.PrintfLine("TYPE I"); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.ReadResponse(200); err != nil {
+		return nil, err
+	}
+
+	if err := c.PrintfLine("PASV"); err != nil {
+		return nil, err
+	}
+	_, msg, err = c.ReadResponse(227)
+	if err != nil {
+		return nil, err
+	}
+	m := pasvAddrRegex.FindStringSubmatch(msg)
+	if m == nil {
+		return nil, fmt.Errorf("invalid passive mode response %q", msg)
+	}
+	p1, _ := strconv.Atoi(m[5])
+	p2, _ := strconv.Atoi(m[6])
+	// the advertised address is ignored, servers behind NAT often get it wrong
+	dataAddr := net.JoinHostPort(u.Hostname(), strconv.Itoa(p1*256+p2))
+
+	dataConn, err := net.DialTimeout("tcp", dataAddr, fileTransferTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer dataConn.Close()
+	dataConn.SetDeadline(time.Now().Add(fileTransferTimeout))
+
+	if err := c.PrintfLine("%s %s", command, u.Path); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.ReadResponse(1); err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	switch command {
+	case "RETR":
+		result, err = io.ReadAll(dataConn)
+	case "STOR":
+		_, err = dataConn.Write(data)
+	default:
+		err = errors.New("unsupported ftp command " + command)
+	}
+	dataConn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := c.ReadResponse(2); err != nil {
+		return nil, err
+	}
+	c.PrintfLine("QUIT")
+	return result, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/firmware"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/securefirmware"
+)
+
+const defaultFirmwareVersion = "v1.0.0"
+
+var (
+	firmwareVersionRegex = regexp.MustCompile(`v?\d+\.\d+(\.\d+)?`)
+
+	firmwareUpdateInProgress atomic.Bool
+)
+
+func (handler *ChargePointHandler) OnUpdateFirmware(request *firmware.UpdateFirmwareRequest) (confirmation *firmware.UpdateFirmwareConfirmation, err error) {
+	appLogger.Println("OnUpdateFirmware", request.Location, request.RetrieveDate)
+
+	if !firmwareUpdateInProgress.CompareAndSwap(false, true) {
+		appLogger.Println("Firmware update already in progress, ignoring request")
+		return firmware.NewUpdateFirmwareConfirmation(), nil
+	}
+
+	retrieveDate := time.Now()
+	if request.RetrieveDate != nil {
+		retrieveDate = request.RetrieveDate.Time
+	}
+	retries, retryInterval := transferRetries(request.Retries, request.RetryInterval)
+
+	go func() {
+		defer firmwareUpdateInProgress.Store(false)
+		updateFirmware(request.Location, retrieveDate, retries, retryInterval)
+	}()
+
+	return firmware.NewUpdateFirmwareConfirmation(), nil
+}
+
+func updateFirmware(location string, retrieveDate time.Time, retries int, retryInterval time.Duration) {
+	time.Sleep(time.Until(retrieveDate))
+
+	var data []byte
+	if err := withRetries("Firmware download", location, retries, retryInterval, func() (err error) {
+		setFirmwareStatus(firmware.FirmwareStatusDownloading)
+		data, err = downloadFile(location)
+		return err
+	}); err != nil {
+		setFirmwareStatus(firmware.FirmwareStatusDownloadFailed)
+		return
+	}
+	setFirmwareStatus(firmware.FirmwareStatusDownloaded)
+
+	version, err := installFirmware(location, data)
+	if err != nil {
+		appLogger.WithError(err).Error("Firmware installation failed")
+		setFirmwareStatus(firmware.FirmwareStatusInstallationFailed)
+		return
+	}
+
+	appLogger.Infoln("Firmware", version, "installed, rebooting")
+	if err := rebootCharger(); err != nil {
+		appLogger.WithError(err).Error("Error rebooting charger")
+	}
+}
+
+// installFirmware waits for the running transaction to end before storing the
+// firmware image and switching to its version, which is reported from the
+// next BootNotification on.
+func installFirmware(location string, data []byte) (string, error) {
+	waitForTxEnd()
+	setFirmwareStatus(firmware.FirmwareStatusInstalling)
+
+	version, err := storeFirmware(location, data)
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("firmware_installed_pending"), []byte("true"))
+	})
+	return version, err
+}
+
+func waitForTxEnd() {
+	for isAnyTxRunning() {
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// storeFirmware writes the firmware image next to the database and makes its
+// version the current one.
+func storeFirmware(location string, data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", errors.New("firmware image is empty")
+	}
+
+	fileName := firmwareFileName(location)
+	dir := filepath.Join(mustGetDBPath(), "firmware")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, fileName), data, 0o644); err != nil {
+		return "", err
+	}
+
+	version := firmwareVersionFrom(fileName, data)
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("firmware_version"), []byte(version))
+	})
+	return version, err
+}
+
+// completeFirmwareInstallation reports the firmware installed before the last
+// reboot, once the charger booted with it.
+func completeFirmwareInstallation() {
+	if pending, _ := KeyExists("firmware_installed_pending"); pending {
+		sendSecurityEvent("FirmwareUpdated", currentFirmwareVersion())
+		setFirmwareStatus(firmware.FirmwareStatusInstalled)
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte("firmware_installed_pending"))
+		})
+	}
+	if pending, _ := KeyExists("signed_firmware_installed_pending"); pending {
+		sendSecurityEvent("FirmwareUpdated", currentFirmwareVersion())
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusInstalled,
+			MustGetIntKey("signed_firmware_installed_pending"))
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte("signed_firmware_installed_pending"))
+		})
+	}
+}
+
+// setFirmwareStatus reports a firmware status and stores the one
+// currentFirmwareStatus returns.
+func setFirmwareStatus(status firmware.FirmwareStatus) {
+	if _, err := chargePoint.FirmwareStatusNotification(status); err != nil {
+		appLogger.WithError(err).Error("Error sending FirmwareStatusNotification ", status)
+	} else {
+		appLogger.Println("FirmwareStatusNotification", status)
+	}
+
+	switch status {
+	case firmware.FirmwareStatusDownloadFailed,
+		firmware.FirmwareStatusInstallationFailed,
+		firmware.FirmwareStatusInstalled:
+		status = firmware.FirmwareStatusIdle
+	}
+	db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("firmware_status"), []byte(status))
+	})
+}
+
+func firmwareFileName(location string) string {
+	fileName := "firmware.bin"
+	if u, err := url.Parse(location); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			fileName = base
+		}
+	}
+	return fileName
+}
+
+// firmwareVersionFrom takes the version from the file name, falling back to
+// the image content when it is a version string, or to a hash of it.
+func firmwareVersionFrom(fileName string, data []byte) string {
+	if v := firmwareVersionRegex.FindString(fileName); v != "" {
+		return v
+	}
+	if content := strings.TrimSpace(string(data)); len(content) < 32 && firmwareVersionRegex.MatchString(content) {
+		return firmwareVersionRegex.FindString(content)
+	}
+	sum := sha256.Sum256(data)
+	return "build-" + hex.EncodeToString(sum[:4])
+}
+
+func currentFirmwareVersion() string {
+	version, _ := GetKeyValue("firmware_version")
+	if version == "" {
+		return defaultFirmwareVersion
+	}
+	return version
+}
+
+func mustGetDBPath() string {
+	p, _ := GetKeyValue("db_path")
+	return p
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	// lastMessageSent is when the last message was written to the central
+	// system, in Unix nanoseconds
+	lastMessageSent atomic.Int64
+
+	// heartbeatIntervalC wakes up the heartbeat scheduler when the
+	// HeartbeatInterval changed
+	heartbeatIntervalC = make(chan struct{}, 1)
+)
+
+// heartbeatInterval returns HeartbeatInterval, heartbeats are disabled when
+// it is 0.
+func heartbeatInterval() time.Duration {
+	return time.Duration(MustGetIntKey("HeartbeatInterval")) * time.Second
+}
+
+// resetHeartbeat makes the heartbeat scheduler apply the HeartbeatInterval
+// right away.
+func resetHeartbeat() {
+	select {
+	case heartbeatIntervalC <- struct{}{}:
+	default:
+	}
+}
+
+// runHeartbeat sends a Heartbeat whenever nothing was sent to the central
+// system for HeartbeatInterval, until stop is closed.
+func runHeartbeat(stop chan struct{}) {
+	var lastAttempt time.Time
+	for {
+		interval := heartbeatInterval()
+		var timeout <-chan time.Time
+		if interval > 0 {
+			last := time.Unix(0, lastMessageSent.Load())
+			if lastAttempt.After(last) {
+				last = lastAttempt
+			}
+			wait := interval - time.Since(last)
+			if wait <= 0 && !isRegistered() {
+				wait = interval
+			}
+			timeout = time.After(wait)
+		}
+
+		select {
+		case <-stop:
+			appLogger.Debugln("stop signal received in heartbeat")
+			return
+		case <-heartbeatIntervalC:
+			continue
+		case <-timeout:
+		}
+
+		// other messages were sent meanwhile, the central system knows the
+		// charge point is alive
+		if !isRegistered() || time.Since(time.Unix(0, lastMessageSent.Load())) < interval {
+			continue
+		}
+		lastAttempt = time.Now()
+		if err := sendHeartbeat(); err != nil {
+			appLogger.WithError(err).Debugln("Heartbeat error")
+			continue
+		}
+		appLogger.Println("Heartbeat sent to central system")
+	}
+}
+
+// migrateHeartbeatIntervalTX moves the interval stored by older versions to
+// HeartbeatInterval.
+func migrateHeartbeatIntervalTX(txn *badger.Txn) error {
+	legacy, err := GetKeyValueTX(txn, "default_heartbeat_interval")
+	if err != nil {
+		return err
+	}
+	if legacy == "" {
+		legacy = "300"
+	}
+	if err := SetIfNotExistsTX(txn, "HeartbeatInterval", legacy); err != nil {
+		return err
+	}
+	return txn.Delete([]byte("default_heartbeat_interval"))
+}
+
+// sendHeartbeat sends a Heartbeat and sets the clock to the central system
+// time it returns.
+func sendHeartbeat() error {
+	sentAt := time.Now()
+	conf, err := chargePoint.Heartbeat()
+	if err != nil {
+		return err
+	}
+	syncClock(conf.CurrentTime, sentAt)
+	return nil
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
-	"github.com/jedib0t/go-pretty/v6/table"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
-	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
 )
 
 func startHttpServer() string {
@@ -24,28 +24,7 @@ func startHttpServer() string {
 		{
 			path: "/list-db",
 			handler: func(w http.ResponseWriter, r *http.Request) {
-				t := table.NewWriter()
-				t.SetOutputMirror(w)
-				t.AppendHeader(table.Row{"Key", "Value", "LTT"})
-				db.View(func(txn *badger.Txn) error {
-					opts := badger.DefaultIteratorOptions
-					opts.PrefetchSize = 10
-					it := txn.NewIterator(opts)
-					defer it.Close()
-					for it.Rewind(); it.Valid(); it.Next() {
-						item := it.Item()
-						k := item.Key()
-						v, _ := item.ValueCopy(nil)
-						if len(v) > 150 {
-							v = []byte(fmt.Sprintf("%s...", v[:150]))
-						}
-						t.AppendRows([]table.Row{
-							{string(k), string(v), item.ExpiresAt()},
-						})
-					}
-					return nil
-				})
-				t.Render()
+				DumpDB(w)
 			},
 		},
 		{
@@ -57,62 +36,143 @@ func startHttpServer() string {
 					return
 				}
 
-				connectorId, _ := strconv.Atoi(r.URL.Query().Get("connectorId"))
-				statusNotification(core.ChargePointStatusAvailable, connectorId)
-				time.Sleep(1 * time.Second)
-				statusNotification(core.ChargePointStatusPreparing, connectorId)
-				if connectorId == 0 {
-					connectorId = currentTxConnectorId()
-				}
-				appLogger.Infoln("Status changed to", core.ChargePointStatusPreparing, "for connector", connectorId)
+				connectorId := queryConnectorId(r)
+				if err := setConnectorStatus(connectorId, core.ChargePointStatusPreparing, core.NoError); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				go expirePreparing(connectorId)
 				w.WriteHeader(http.StatusNoContent)
 			},
 		},
 		{
-			path: "/ev-stop",
+			path: "/status",
 			handler: func(w http.ResponseWriter, r *http.Request) {
 				if !chargePoint.IsConnected() {
-					w.Write([]byte("Charge Point not connected"))
 					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("Charge Point not connected"))
 					return
 				}
 
-				if !isTxRunning() {
+				connectorId := queryConnectorId(r)
+				status := core.ChargePointStatus(r.URL.Query().Get("status"))
+				errorCode := core.ChargePointErrorCode(r.URL.Query().Get("errorCode"))
+				if err := setConnectorStatus(connectorId, status, errorCode); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			path: "/tap",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				connectorId := queryConnectorId(r)
+				idTag := r.URL.Query().Get("idTag")
+				info, err := tapIdTag(connectorId, idTag)
+				switch {
+				case errors.Is(err, errIdTagNotAccepted):
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(fmt.Sprintf("idTag %s %s", idTag, info.Status)))
+					return
+				case err != nil:
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte(fmt.Sprintf("idTag %s %s on connector %d", idTag, info.Status, connectorId)))
+			},
+		},
+		{
+			path: "/ev-stop",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				// the EV may be unplugged while offline, the StopTransaction is
+				// delivered once connected again
+				connectorId := queryConnectorId(r)
+				if !isTxRunning(connectorId) {
 					w.Write([]byte("No transaction running"))
 					w.WriteHeader(http.StatusBadRequest)
 					return
 				}
-				ts := types.Now()
-				txId := currentTxId()
-
-				energy := MustGetIntKey(EnergyKey)
 
-				conf, err := chargePoint.StopTransaction(
-					energy,
-					ts,
-					txId,
-					func(request *core.StopTransactionRequest) {
-						request.Reason = core.ReasonEVDisconnected
-						request.IdTag = currentTxIdTag()
-					},
-				)
+				if err := stopTransaction(connectorId, core.ReasonEVDisconnected); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				go func() {
+					handler.StopRemoteScenario(connectorId)
+					resetCurrentTx(connectorId)
+				}()
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			path: "/auth-cache",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				entries, err := listAuthCache()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(entries)
+			},
+		},
+		{
+			path: "/client-certificate",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					w.Write([]byte("POST the PEM encoded certificate chain and private key"))
+					return
+				}
+				body, err := io.ReadAll(r.Body)
 				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err := installClientCertificate(body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				appLogger.Infoln("Charge point certificate installed")
+				w.Write([]byte("Charge Point certificate installed"))
+			},
+		},
+		{
+			path: "/clear-security-log",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if err := securityLog.Clear(); err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				status := conf.IdTagInfo.Status
-				switch status {
-				case types.AuthorizationStatusAccepted:
-					appLogger.Infoln("Transaction stopped", txId, status)
-					go func() {
-						handler.StopRemoteScenario()
-						resetCurrentTx()
-					}()
+				sendSecurityEvent("SecurityLogWasCleared", "")
+				w.Write([]byte("Security log cleared"))
+			},
+		},
+		{
+			path: "/sign-certificate",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if !chargePoint.IsConnected() {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("Charge Point not connected"))
 					return
-				default:
-					appLogger.Println("Transaction will not stop", txId, status)
 				}
-				w.WriteHeader(http.StatusNoContent)
+				if err := requestCertificateSigning(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Write([]byte("SignCertificate sent"))
+			},
+		},
+		{
+			path: "/connection",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(struct {
+					ConnectionStatus
+					Registration core.RegistrationStatus `json:"registration"`
+					Transitions  []logLine               `json:"transitions"`
+				}{currentConnectionStatus(), registrationStatus(), connectionLog.Between(time.Time{}, time.Time{})})
 			},
 		},
 		{
@@ -181,3 +241,13 @@ func startHttpServer() string {
 	appLogger.Infoln("Control Server started on port", port)
 	return port
 }
+
+// queryConnectorId returns the connectorId query parameter, connector 1 when
+// it is missing.
+func queryConnectorId(r *http.Request) int {
+	connectorId, err := strconv.Atoi(r.URL.Query().Get("connectorId"))
+	if err != nil {
+		return 1
+	}
+	return connectorId
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/localauth"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const (
+	localAuthKeyPrefix  = "local_auth__"
+	localListVersionKey = "local_list_version"
+)
+
+var errVersionMismatch = errors.New("local list version mismatch")
+
+func (handler *ChargePointHandler) OnGetLocalListVersion(request *localauth.GetLocalListVersionRequest) (confirmation *localauth.GetLocalListVersionConfirmation, err error) {
+	appLogger.Println("OnGetLocalListVersion")
+	if !MustGetBoolKey("LocalAuthListEnabled") {
+		return localauth.NewGetLocalListVersionConfirmation(-1), nil
+	}
+	return localauth.NewGetLocalListVersionConfirmation(MustGetIntKey(localListVersionKey)), nil
+}
+
+func (handler *ChargePointHandler) OnSendLocalList(request *localauth.SendLocalListRequest) (confirmation *localauth.SendLocalListConfirmation, err error) {
+	appLogger.Println("OnSendLocalList", request.UpdateType, request.ListVersion, len(request.LocalAuthorizationList))
+
+	if !MustGetBoolKey("LocalAuthListEnabled") {
+		return localauth.NewSendLocalListConfirmation(localauth.UpdateStatusNotSupported), nil
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		sendMax := MustGetIntKeyTX(txn, "SendLocalListMaxLength")
+		if sendMax > 0 && len(request.LocalAuthorizationList) > sendMax {
+			return fmt.Errorf("list of %d entries exceeds SendLocalListMaxLength", len(request.LocalAuthorizationList))
+		}
+
+		switch request.UpdateType {
+		case localauth.UpdateTypeFull:
+			if err := clearLocalListTX(txn); err != nil {
+				return err
+			}
+		case localauth.UpdateTypeDifferential:
+			if request.ListVersion <= MustGetIntKeyTX(txn, localListVersionKey) {
+				return errVersionMismatch
+			}
+		default:
+			return fmt.Errorf("unknown update type %s", request.UpdateType)
+		}
+
+		for _, data := range request.LocalAuthorizationList {
+			key := []byte(localAuthKeyPrefix + data.IdTag)
+			if data.IdTagInfo == nil {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			v, err := json.Marshal(data.IdTagInfo)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(key, v); err != nil {
+				return err
+			}
+		}
+
+		listMax := MustGetIntKeyTX(txn, "LocalAuthListMaxLength")
+		if n := len(listLocalAuthKeysTX(txn)); listMax > 0 && n > listMax {
+			return fmt.Errorf("list of %d entries exceeds LocalAuthListMaxLength", n)
+		}
+
+		return txn.Set([]byte(localListVersionKey), []byte(strconv.Itoa(request.ListVersion)))
+	}); err != nil {
+		if errors.Is(err, errVersionMismatch) {
+			return localauth.NewSendLocalListConfirmation(localauth.UpdateStatusVersionMismatch), nil
+		}
+		appLogger.WithError(err).Error("Error updating local authorization list")
+		return localauth.NewSendLocalListConfirmation(localauth.UpdateStatusFailed), nil
+	}
+
+	return localauth.NewSendLocalListConfirmation(localauth.UpdateStatusAccepted), nil
+}
+
+// getLocalListEntry returns the IdTagInfo the local authorization list holds
+// for idTag, or nil when it is not listed.
+func getLocalListEntry(idTag string) (*types.IdTagInfo, error) {
+	var info *types.IdTagInfo
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(localAuthKeyPrefix + idTag))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		info = &types.IdTagInfo{}
+		return json.Unmarshal(v, info)
+	})
+	return info, err
+}
+
+func listLocalAuthKeysTX(txn *badger.Txn) [][]byte {
+	keys := [][]byte{}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(localAuthKeyPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	return keys
+}
+
+func clearLocalListTX(txn *badger.Txn) error {
+	for _, key := range listLocalAuthKeysTX(txn) {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	messageJournalSize = 2000
+
+	rotatingLogMaxSize  = 1 << 20 // 1MB
+	rotatingLogMaxFiles = 5
+)
+
+var (
+	messageJournal = newLineRing(messageJournalSize)
+
+	diagnosticsLog *rotatingLog
+	securityLog    *rotatingLog
+)
+
+type logLine struct {
+	Time time.Time
+	Line string
+}
+
+// lineWriter stores timestamped lines and returns them filtered by time.
+type lineWriter interface {
+	Add(t time.Time, line string)
+	Between(from, to time.Time) []logLine
+}
+
+// lineRing keeps the last size lines written to it.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []logLine
+	next  int
+	size  int
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{size: size, lines: make([]logLine, 0, size)}
+}
+
+func (r *lineRing) Add(t time.Time, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := logLine{Time: t, Line: strings.TrimRight(line, "\n")}
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, l)
+		return
+	}
+	r.lines[r.next] = l
+	r.next = (r.next + 1) % r.size
+}
+
+// Between returns the lines written within [from, to] in order, a zero bound
+// is open.
+func (r *lineRing) Between(from, to time.Time) []logLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := []logLine{}
+	for i := 0; i < len(r.lines); i++ {
+		l := r.lines[(r.next+i)%len(r.lines)]
+		if inTimeRange(l.Time, from, to) {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func (r *lineRing) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = r.lines[:0]
+	r.next = 0
+}
+
+// rotatingLog keeps timestamped lines on disk, once the current file reaches
+// maxSize it is rotated to path.1, path.1 to path.2 and so on, dropping the
+// oldest file past maxFiles.
+type rotatingLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingLog(path string, maxSize int64, maxFiles int) (*rotatingLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	l := &rotatingLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *rotatingLog) rotate() error {
+	l.file.Close()
+	os.Remove(l.rotatedPath(l.maxFiles))
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(l.rotatedPath(i), l.rotatedPath(i+1))
+	}
+	if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *rotatingLog) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+func (l *rotatingLog) Add(t time.Time, line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	line = strings.ReplaceAll(strings.TrimRight(line, "\n"), "\n", `\n`)
+	n, err := fmt.Fprintf(l.file, "%s\t%s\n", t.Format(time.RFC3339Nano), line)
+	if err != nil {
+		return
+	}
+	l.size += int64(n)
+	if l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to rotate log", l.path, err)
+		}
+	}
+}
+
+// Between returns the lines written within [from, to] from the oldest file to
+// the current one, a zero bound is open. Only opening the files holds up Add,
+// a rotation meanwhile doesn't affect the open files.
+func (l *rotatingLog) Between(from, to time.Time) []logLine {
+	l.mu.Lock()
+	files := []*os.File{}
+	for i := l.maxFiles; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotatedPath(i)
+		}
+		if f, err := os.Open(path); err == nil {
+			files = append(files, f)
+		}
+	}
+	l.mu.Unlock()
+
+	lines := []logLine{}
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			ts, line, ok := strings.Cut(scanner.Text(), "\t")
+			if !ok {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, ts)
+			if err != nil || !inTimeRange(t, from, to) {
+				continue
+			}
+			lines = append(lines, logLine{Time: t, Line: line})
+		}
+		f.Close()
+	}
+	return lines
+}
+
+// Clear removes the current and rotated files and starts an empty one.
+func (l *rotatingLog) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	for i := 1; i <= l.maxFiles; i++ {
+		os.Remove(l.rotatedPath(i))
+	}
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func inTimeRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && t.After(to) {
+		return false
+	}
+	return true
+}
+
+func joinLines(lines []logLine) []byte {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l.Time.Format(time.RFC3339Nano))
+		b.WriteByte(' ')
+		b.WriteString(l.Line)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// openLogs opens the on-disk diagnostics and security logs in dir and starts
+// copying every log entry to the diagnostics one.
+func openLogs(dir string) error {
+	var err error
+	diagnosticsLog, err = openRotatingLog(filepath.Join(dir, "emulator.log"), rotatingLogMaxSize, rotatingLogMaxFiles)
+	if err != nil {
+		return err
+	}
+	securityLog, err = openRotatingLog(filepath.Join(dir, "security.log"), rotatingLogMaxSize, rotatingLogMaxFiles)
+	if err != nil {
+		return err
+	}
+	ll.AddHook(&lineWriterHook{writer: diagnosticsLog})
+	return nil
+}
+
+// lineWriterHook copies every log entry to a lineWriter.
+type lineWriterHook struct {
+	writer lineWriter
+}
+
+func (h *lineWriterHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *lineWriterHook) Fire(entry *log.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	h.writer.Add(entry.Time, line)
+	return nil
+}
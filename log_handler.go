@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/logging"
+)
+
+// currentLogUpload holds the request id of the running log upload, 0 when
+// there is none. A new GetLog cancels the running upload.
+var currentLogUpload atomic.Int64
+
+func (handler *ChargePointHandler) OnGetLog(request *logging.GetLogRequest) (response *logging.GetLogResponse, err error) {
+	appLogger.Println("GetLog", request.LogType, request.RequestID, request.Log.RemoteLocation)
+
+	var source lineWriter
+	switch request.LogType {
+	case logging.LogTypeDiagnostics:
+		source = diagnosticsLog
+	case logging.LogTypeSecurity:
+		source = securityLog
+	default:
+		return logging.NewGetLogResponse(logging.LogStatusRejected), nil
+	}
+
+	u, err := url.Parse(request.Log.RemoteLocation)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ftp") {
+		appLogger.Println("Unsupported log remote location", request.Log.RemoteLocation)
+		return logging.NewGetLogResponse(logging.LogStatusRejected), nil
+	}
+
+	var from, to time.Time
+	if request.Log.OldestTimestamp != nil {
+		from = request.Log.OldestTimestamp.Time
+	}
+	if request.Log.LatestTimestamp != nil {
+		to = request.Log.LatestTimestamp.Time
+	}
+	retries, retryInterval := transferRetries(request.Retries, request.RetryInterval)
+
+	status := logging.LogStatusAccepted
+	if previous := currentLogUpload.Swap(int64(request.RequestID)); previous != 0 {
+		appLogger.Println("Canceling log upload", previous)
+		status = logging.LogStatusAcceptedCanceled
+	}
+
+	fileName := fmt.Sprintf("%s_%s_%d.log", chargePointId, request.LogType, request.RequestID)
+	response = logging.NewGetLogResponse(status)
+	response.Filename = fileName
+
+	afterConfirmation(func() {
+		uploadLog(source, request.Log.RemoteLocation, fileName, from, to,
+			request.RequestID, retries, retryInterval)
+	})
+
+	return response, nil
+}
+
+func uploadLog(source lineWriter, location, fileName string, from, to time.Time, requestId, retries int, retryInterval time.Duration) {
+	defer currentLogUpload.CompareAndSwap(int64(requestId), 0)
+	canceled := func() bool {
+		return currentLogUpload.Load() != int64(requestId)
+	}
+
+	data := joinLines(source.Between(from, to))
+
+	err := withRetries("Log upload", location, retries, retryInterval, func() error {
+		if canceled() {
+			return errTransferCanceled
+		}
+		setLogStatus(logging.UploadLogStatusUploading, requestId)
+		return uploadFile(location, fileName, data)
+	})
+
+	switch {
+	case errors.Is(err, errTransferCanceled):
+		appLogger.Println("Log upload canceled", requestId)
+	case errors.Is(err, errPermissionDenied):
+		appLogger.WithError(err).Error("Log upload failed")
+		setLogStatus(logging.UploadLogStatusPermissionDenied, requestId)
+	case err != nil:
+		setLogStatus(logging.UploadLogStatusUploadFailure, requestId)
+	default:
+		appLogger.Infoln("Log uploaded", fileName)
+		setLogStatus(logging.UploadLogStatusUploaded, requestId)
+	}
+}
+
+// setLogStatus reports the status of a log upload, see currentLogStatus.
+func setLogStatus(status logging.UploadLogStatus, requestId int) {
+	if _, err := chargePoint.SendRequest(logging.NewLogStatusNotificationRequest(status, requestId)); err != nil {
+		appLogger.WithError(err).Error("Error sending LogStatusNotification ", status)
+	} else {
+		appLogger.Println("LogStatusNotification", status, requestId)
+	}
+
+	if status != logging.UploadLogStatusUploading {
+		status = logging.UploadLogStatusIdle
+	}
+	db.Update(func(txn *badger.Txn) error {
+		txn.Set([]byte("log_status"), []byte(status))
+		return txn.Set([]byte("log_request_id"), []byte(strconv.Itoa(requestId)))
+	})
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,7 +15,7 @@ import (
 
 	"github.com/dgraph-io/badger/v4"
 	ocpp16 "github.com/lorenzodonini/ocpp-go/ocpp1.6"
-	"github.com/lorenzodonini/ocpp-go/ocpp1.6/firmware"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
 	"github.com/lorenzodonini/ocpp-go/ws"
 	log "github.com/sirupsen/logrus"
 )
@@ -83,6 +82,12 @@ func main() {
 	defer badgerDB.Close()
 	db = badgerDB
 
+	if err := openLogs(filepath.Join(dbPath, "logs")); err != nil {
+		log.Fatal(err)
+	}
+	defer diagnosticsLog.Close()
+	defer securityLog.Close()
+
 	// store setup configuration
 	if err := db.Update(func(txn *badger.Txn) error {
 		// txn.Set([]byte("SecurityProfile"), []byte(fmt.Sprintf("%d", NoSecurityProfile)))
@@ -98,13 +103,47 @@ func main() {
 		SetIfNotExistsTX(txn, "SecurityProfile", fmt.Sprintf("%d", NoSecurityProfile))
 		SetIfNotExistsTX(txn, "MeterValueSampleInterval", "300")
 		SetIfNotExistsTX(txn, "MeterValuesSampledData", "Energy.Active.Import.Register")
-		SetIfNotExistsTX(txn, "CertificateStoreMaxLength", "1")
-		SetIfNotExistsTX(txn, "default_heartbeat_interval", "300")
-		return nil
+		if err := migrateCertificateStoreMaxLengthTX(txn); err != nil {
+			return err
+		}
+		SetIfNotExistsTX(txn, "CertificateStoreMaxLength", fmt.Sprintf("%d", defaultCertificateStoreMaxLength))
+		if err := migrateHeartbeatIntervalTX(txn); err != nil {
+			return err
+		}
+		SetIfNotExistsTX(txn, "NumberOfConnectors", "1")
+		SetIfNotExistsTX(txn, "SupportedFileTransferProtocols", "FTP,HTTP,HTTPS")
+		SetIfNotExistsTX(txn, "ChargeProfileMaxStackLevel", "10")
+		SetIfNotExistsTX(txn, "ChargingScheduleAllowedChargingRateUnit", "Current,Power")
+		SetIfNotExistsTX(txn, "ChargingScheduleMaxPeriods", "24")
+		SetIfNotExistsTX(txn, "MaxChargingProfilesInstalled", "10")
+		SetIfNotExistsTX(txn, "LocalAuthListEnabled", "true")
+		SetIfNotExistsTX(txn, "LocalAuthListMaxLength", "100")
+		SetIfNotExistsTX(txn, "SendLocalListMaxLength", "50")
+		SetIfNotExistsTX(txn, "LocalAuthorizeOffline", "true")
+		SetIfNotExistsTX(txn, "LocalPreAuthorize", "false")
+		SetIfNotExistsTX(txn, "ResetRetries", "1")
+		SetIfNotExistsTX(txn, "AuthorizeRemoteTxRequests", "false")
+		SetIfNotExistsTX(txn, "AuthorizationCacheEnabled", "true")
+		SetIfNotExistsTX(txn, "StopTransactionOnInvalidId", "true")
+		SetIfNotExistsTX(txn, "TransactionMessageAttempts", "3")
+		SetIfNotExistsTX(txn, "TransactionMessageRetryInterval", "60")
+		SetIfNotExistsTX(txn, "ConnectionTimeOut", "120")
+		SetIfNotExistsTX(txn, "RetryBackOffWaitMinimum", "10")
+		SetIfNotExistsTX(txn, "RetryBackOffRandomRange", "10")
+		SetIfNotExistsTX(txn, "RetryBackOffRepeatTimes", "5")
+		SetIfNotExistsTX(txn, "WebSocketPingInterval", "54")
+		if err := migrateLegacyTransactionTX(txn); err != nil {
+			return err
+		}
+		return migrateLegacyCertificatesTX(txn)
 	}); err != nil {
 		log.Fatal(err)
 	}
 
+	go runSecurityEventsSender()
+	go runTransactionMessagesSender()
+	sendSecurityEvent("StartupOfTheDevice", "")
+
 	httpPort := startHttpServer()
 	appLogger = appLogger.WithField("control_port", httpPort)
 
@@ -116,7 +155,8 @@ func main() {
 	}
 
 	if err := startChargePoint(client); err != nil {
-		appLogger.WithError(err).Fatalln("startChargePoint")
+		appLogger.WithError(err).Errorln("startChargePoint")
+		go superviseConnection(err)
 	}
 
 	<-signals
@@ -133,6 +173,7 @@ func main() {
 	}()
 
 	fmt.Println("Gracefully shutting down...")
+	autoReconnect.Store(false)
 
 	db.Update(func(txn *badger.Txn) error {
 		return txn.Set([]byte("stopped_at"), []byte(time.Now().Format(time.RFC3339)))
@@ -168,25 +209,32 @@ func bootCharger() error {
 }
 
 func stopCharger() error {
+	autoReconnect.Store(false)
 	if !chargePoint.IsConnected() {
 		return errors.New("charge point not connected")
 	}
 	closeStopC()
 	chargePoint.Stop()
+	setConnectionState(ConnectionStateDisconnected, 0, nil)
+	forgetRegistration()
 	return nil
 }
 
 func rebootCharger() error {
+	sendSecurityEvent("ResetOrReboot", "")
 	if chargePoint.IsConnected() {
 		closeStopC()
 		chargePoint.Stop()
+		setConnectionState(ConnectionStateDisconnected, 0, nil)
 	}
+	forgetRegistration()
 	appLogger.Infoln("Charge Point stopped")
 	client, err := setUpSecurityOnWsClient()
 	if err != nil {
 		return err
 	}
 	if err := startChargePoint(client); err != nil {
+		go superviseConnection(err)
 		return err
 	}
 	return nil
@@ -222,17 +270,10 @@ func setUpSecurityOnWsClient() (*ws.Client, error) {
 			if password == "" {
 				return errors.New("password is not set for this profile")
 			}
-			rootCert, err := GetKeyValueTX(txn, "root_certificate")
+			certPool, err := certificatePoolTX(txn, types.CentralSystemRootCertificate)
 			if err != nil {
 				return err
 			}
-			if rootCert == "" {
-				return errors.New("not all security profile keys are set")
-			}
-			certPool := x509.NewCertPool()
-			if !certPool.AppendCertsFromPEM([]byte(rootCert)) {
-				return errors.New("failed to append root certificate")
-			}
 
 			// we need to create a new tls client
 			client = ws.NewTLSClient(&tls.Config{
@@ -241,19 +282,47 @@ func setUpSecurityOnWsClient() (*ws.Client, error) {
 
 			client.SetBasicAuth(chargePointId, password)
 
+		} else if profile == TLSWithClientSideCertificatesProfile {
+			if !strings.HasPrefix(csUrl, "wss://") {
+				return errors.New("central system url must be wss:// for this profile")
+			}
+
+			certPool, err := certificatePoolTX(txn, types.CentralSystemRootCertificate)
+			if err != nil {
+				return err
+			}
+
+			clientCert, err := loadClientCertificateTX(txn)
+			if err != nil {
+				return err
+			}
+
+			// the charge point authenticates with its certificate, not with
+			// basic auth
+			client = ws.NewTLSClient(&tls.Config{
+				RootCAs:      certPool,
+				Certificates: []tls.Certificate{clientCert},
+			})
+
 		} else {
 			return fmt.Errorf("security profile: %d not supported", profile)
 		}
 		return nil
 	})
+	client.SetTimeoutConfig(wsTimeoutConfig())
 	return client, err
 }
 
 func startChargePoint(wsClient *ws.Client) error {
-	chargePoint = ocpp16.NewChargePoint(chargePointId, nil, wsClient)
+	chargePoint = ocpp16.NewChargePoint(chargePointId, nil, newJournalingWsClient(wsClient))
 
 	handler = &ChargePointHandler{}
 	chargePoint.SetCoreHandler(handler)
+	chargePoint.SetReservationHandler(handler)
+	chargePoint.SetSmartChargingHandler(handler)
+	chargePoint.SetLocalAuthListHandler(handler)
+	chargePoint.SetRemoteTriggerHandler(handler)
+	chargePoint.SetFirmwareManagementHandler(handler)
 
 	chargePoint.SetSecurityHandler(handler)
 	chargePoint.SetLogHandler(handler)
@@ -262,54 +331,49 @@ func startChargePoint(wsClient *ws.Client) error {
 	chargePoint.SetCertificateHandler(handler)
 
 	// Connects to central system
+	setConnectionState(ConnectionStateConnecting, 0, nil)
 	if err := chargePoint.Start(csUrl); err != nil {
+		setConnectionState(ConnectionStateDisconnected, 0, err)
+		connectionSecurityEvent(err)
 		return err
 	}
+	setConnectionState(ConnectionStateConnected, 0, nil)
+	autoReconnect.Store(true)
 
-	// Charger Operation
-	if err := bootNotification(); err != nil {
+	// Charger Operation, a new connection only requires a BootNotification
+	// when the charge point isn't registered yet
+	stopC = make(chan struct{})
+	if isRegistered() {
+		go resumeCharger()
+	} else if err := bootNotification(); err != nil {
+		// disconnect so that starting again is possible
+		chargePoint.Stop()
+		setConnectionState(ConnectionStateDisconnected, 0, err)
 		return err
 	}
 
-	stopC = make(chan struct{})
-
-	go func() {
-		for {
-			interval := MustGetIntKey("default_heartbeat_interval")
-			time.Sleep(time.Duration(interval) * time.Second)
-
-			select {
-			case <-stopC:
-				appLogger.Debugln("stop signal received in heartbeat")
-				return
-			default:
-			}
+	restoreReservations()
 
-			_, err := chargePoint.Heartbeat()
-			if err != nil {
-				appLogger.WithError(err).Debugln("Heartbeat error")
-				continue
-			}
-			appLogger.Println("Heartbeat sent to central system")
-		}
-	}()
+	go runHeartbeat(stopC)
 
+	stop := stopC
 	go func() {
 		for range time.Tick(20 * time.Minute) {
 			select {
-			case <-stopC:
+			case <-stop:
 				appLogger.Debugln("stop signal received in heartbeat")
 				return
 			default:
 			}
 
-			_, err := chargePoint.DiagnosticsStatusNotification(firmware.DiagnosticsStatusIdle)
+			status := currentDiagnosticsStatus()
+			_, err := chargePoint.DiagnosticsStatusNotification(status)
 
 			if err != nil {
 				appLogger.WithError(err).Debugln("DiagnosticsStatusNotification")
 				continue
 			}
-			appLogger.Debugln("DiagnosticsStatusNotification", firmware.DiagnosticsStatusIdle)
+			appLogger.Debugln("DiagnosticsStatusNotification", status)
 		}
 	}()
 
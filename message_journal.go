@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ws"
+)
+
+// journalingWsClient records every OCPP message exchanged with the central
+// system in the message journal, and holds back the requests the charge point
+// may not send before its registration was accepted.
+type journalingWsClient struct {
+	*ws.Client
+}
+
+func newJournalingWsClient(client *ws.Client) *journalingWsClient {
+	return &journalingWsClient{Client: client}
+}
+
+func (c *journalingWsClient) Write(data []byte) error {
+	if err := checkRegistration(data); err != nil {
+		return err
+	}
+	err := c.Client.Write(data)
+	if err == nil {
+		now := time.Now()
+		lastMessageSent.Store(now.UnixNano())
+		messageJournal.Add(now, "-> "+string(data))
+	}
+	return err
+}
+
+// SetDisconnectedHandler and SetReconnectedHandler let the connection
+// supervisor follow the reconnections made by the websocket client.
+func (c *journalingWsClient) SetDisconnectedHandler(handler func(err error)) {
+	c.Client.SetDisconnectedHandler(func(err error) {
+		handler(err)
+		onConnectionLost(err)
+	})
+}
+
+func (c *journalingWsClient) SetReconnectedHandler(handler func()) {
+	c.Client.SetReconnectedHandler(func() {
+		handler()
+		onReconnected()
+	})
+}
+
+func (c *journalingWsClient) SetMessageHandler(handler func(data []byte) error) {
+	c.Client.SetMessageHandler(func(data []byte) error {
+		messageJournal.Add(time.Now(), "<- "+string(data))
+		return handler(data)
+	})
+}
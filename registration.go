@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/go-faker/faker/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+)
+
+const (
+	// ocppCallMessageType is the message type id of an OCPP-J request
+	ocppCallMessageType = 2
+
+	// defaultBootRetryInterval is used when neither the central system nor
+	// HeartbeatInterval give an interval
+	defaultBootRetryInterval = 60 * time.Second
+)
+
+var (
+	errNotRegistered = errors.New("charge point not accepted by the central system")
+
+	// registration is the status of the last BootNotification of this run,
+	// the charge point has to register again after starting
+	registration atomic.Value
+
+	// bootRetryInterval is the interval the central system asked to wait
+	// before sending BootNotification again
+	bootRetryInterval atomic.Int64
+	retryingBoot      atomic.Bool
+
+	// triggeredActions counts the triggered messages being sent by action,
+	// they may be sent while the registration is Pending
+	triggeredActionsMu sync.Mutex
+	triggeredActions   = map[string]int{}
+)
+
+// bootNotification registers the charge point with the central system. Once
+// Accepted, the interval is the heartbeat interval. Pending and Rejected keep
+// the charge point from sending other messages and BootNotification is sent
+// again after the interval.
+func bootNotification() error {
+	sentAt := time.Now()
+	result, err := chargePoint.BootNotification(
+		faker.LastName(), faker.FirstName(),
+		func(request *core.BootNotificationRequest) {
+			request.ChargePointSerialNumber = faker.CCNumber()
+			request.MeterSerialNumber = faker.CCNumber()
+			request.MeterType = faker.CCNumber()
+			request.Iccid = faker.CCNumber()
+			request.FirmwareVersion = currentFirmwareVersion()
+		})
+	if err != nil {
+		return err
+	}
+
+	syncClock(result.CurrentTime, sentAt)
+	previous := registrationStatus()
+	registration.Store(result.Status)
+	appLogger.WithField("interval", result.Interval).Infoln("BootNotification", result.Status)
+
+	if result.Status != core.RegistrationStatusAccepted {
+		bootRetryInterval.Store(int64(result.Interval))
+		go retryBootNotification()
+		return nil
+	}
+
+	if result.Interval > 0 {
+		if err := db.Update(func(txn *badger.Txn) error {
+			i := fmt.Sprintf("%d", result.Interval)
+			return txn.Set([]byte("HeartbeatInterval"), []byte(i))
+		}); err != nil {
+			return err
+		}
+		resetHeartbeat()
+	}
+	if previous != core.RegistrationStatusAccepted {
+		go onRegistered()
+	}
+	return nil
+}
+
+// registrationStatus returns the status of the last BootNotification.
+func registrationStatus() core.RegistrationStatus {
+	status, _ := registration.Load().(core.RegistrationStatus)
+	return status
+}
+
+// forgetRegistration makes the charge point register again when it starts,
+// as after a power cycle.
+func forgetRegistration() {
+	registration.Store(core.RegistrationStatus(""))
+}
+
+func isRegistered() bool {
+	return registrationStatus() == core.RegistrationStatusAccepted
+}
+
+// retryBootNotification sends BootNotification again after the interval for
+// as long as the charge point isn't Accepted, a single retry loop runs at a
+// time.
+func retryBootNotification() {
+	if !retryingBoot.CompareAndSwap(false, true) {
+		return
+	}
+	defer retryingBoot.Store(false)
+
+	stop := stopC
+	for !isRegistered() {
+		interval := time.Duration(bootRetryInterval.Load()) * time.Second
+		if interval <= 0 {
+			interval = heartbeatInterval()
+		}
+		if interval <= 0 {
+			interval = defaultBootRetryInterval
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		if isRegistered() {
+			return
+		}
+		if err := bootNotification(); err != nil {
+			appLogger.WithError(err).Error("Error sending BootNotification")
+		}
+	}
+}
+
+// onRegistered sends what was held back until the central system accepted
+// the charge point.
+func onRegistered() {
+	reportConnectorStatuses()
+	completeFirmwareInstallation()
+	flushSecurityEvents()
+	flushTransactionMessages()
+	resumeScenarios()
+}
+
+// allowTriggered lets the messages of the action through while the
+// registration is Pending, until the returned function is called.
+func allowTriggered(action string) func() {
+	triggeredActionsMu.Lock()
+	triggeredActions[action]++
+	triggeredActionsMu.Unlock()
+	return func() {
+		triggeredActionsMu.Lock()
+		defer triggeredActionsMu.Unlock()
+		if triggeredActions[action]--; triggeredActions[action] <= 0 {
+			delete(triggeredActions, action)
+		}
+	}
+}
+
+// mayRequest tells whether the charge point may send a request of the action
+// in its registration status: anything once Accepted, BootNotification
+// always, and while Pending the messages triggered by the central system.
+func mayRequest(action string) bool {
+	if action == core.BootNotificationFeatureName {
+		return true
+	}
+	switch registrationStatus() {
+	case core.RegistrationStatusAccepted:
+		return true
+	case core.RegistrationStatusPending:
+		triggeredActionsMu.Lock()
+		defer triggeredActionsMu.Unlock()
+		return triggeredActions[action] > 0
+	}
+	return false
+}
+
+// checkRegistration returns errNotRegistered when data is a request the
+// charge point may not send before being accepted.
+func checkRegistration(data []byte) error {
+	var message []json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil || len(message) < 3 {
+		return nil
+	}
+	var messageType int
+	var action string
+	if json.Unmarshal(message[0], &messageType) != nil || messageType != ocppCallMessageType {
+		return nil
+	}
+	if json.Unmarshal(message[2], &action) != nil || mayRequest(action) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s not sent while %s", errNotRegistered, action, registrationStatus())
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/reservation"
+)
+
+const reservationKeyPrefix = "reservation__"
+
+var (
+	// reservationTimers holds the expiry timer of each reservation by id, a
+	// reservation made again with the same id replaces its timer
+	reservationTimersMu sync.Mutex
+	reservationTimers   = map[int]*time.Timer{}
+)
+
+type Reservation struct {
+	ReservationId int       `json:"reservation_id"`
+	ConnectorId   int       `json:"connector_id"`
+	IdTag         string    `json:"id_tag"`
+	ParentIdTag   string    `json:"parent_id_tag,omitempty"`
+	ExpiryDate    time.Time `json:"expiry_date"`
+}
+
+func (r *Reservation) Expired() bool {
+	return !time.Now().Before(r.ExpiryDate)
+}
+
+func (handler *ChargePointHandler) OnReserveNow(request *reservation.ReserveNowRequest) (confirmation *reservation.ReserveNowConfirmation, err error) {
+	connectorId := request.ConnectorId
+	appLogger.Println("OnReserveNow", request.ReservationId, connectorId, request.IdTag)
+
+	if connectorId <= 0 {
+		appLogger.Println("Reservation of connector 0 is not supported")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusRejected), nil
+	}
+	if connectorId > numberOfConnectors() {
+		appLogger.WithField("connectorId", connectorId).Println("Unknown connector")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusRejected), nil
+	}
+	if request.ExpiryDate == nil || !request.ExpiryDate.After(time.Now()) {
+		appLogger.Println("Reservation expiry date is in the past")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusRejected), nil
+	}
+	if !isOperative(connectorId) {
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusUnavailable), nil
+	}
+	if isTxRunning(connectorId) {
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusOccupied), nil
+	}
+	switch connectorStatus(connectorId) {
+	case core.ChargePointStatusPreparing, core.ChargePointStatusCharging,
+		core.ChargePointStatusSuspendedEV, core.ChargePointStatusSuspendedEVSE,
+		core.ChargePointStatusFinishing:
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusOccupied), nil
+	case core.ChargePointStatusFaulted:
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusFaulted), nil
+	}
+
+	existing, err := getReservation(connectorId)
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading reservation")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusFaulted), nil
+	}
+	if existing != nil && existing.ReservationId != request.ReservationId {
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusOccupied), nil
+	}
+
+	// a reservation with the same id replaces the previous one, even if it was
+	// made for another connector
+	previous, err := findReservation(request.ReservationId)
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading reservation")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusFaulted), nil
+	}
+
+	res := Reservation{
+		ReservationId: request.ReservationId,
+		ConnectorId:   connectorId,
+		IdTag:         request.IdTag,
+		ParentIdTag:   request.ParentIdTag,
+		ExpiryDate:    request.ExpiryDate.Time,
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		if previous != nil && previous.ConnectorId != connectorId {
+			if err := txn.Delete([]byte(reservationKey(previous.ConnectorId))); err != nil {
+				return err
+			}
+		}
+		return setReservationTX(txn, res)
+	}); err != nil {
+		appLogger.WithError(err).Error("Error storing reservation")
+		return reservation.NewReserveNowConfirmation(reservation.ReservationStatusFaulted), nil
+	}
+
+	go func() {
+		if previous != nil && previous.ConnectorId != connectorId {
+			releaseReservedConnector(previous.ConnectorId)
+		}
+		setConnectorStatus(connectorId, core.ChargePointStatusReserved, core.NoError)
+	}()
+	scheduleReservationExpiry(res)
+
+	return reservation.NewReserveNowConfirmation(reservation.ReservationStatusAccepted), nil
+}
+
+func (handler *ChargePointHandler) OnCancelReservation(request *reservation.CancelReservationRequest) (confirmation *reservation.CancelReservationConfirmation, err error) {
+	appLogger.Println("OnCancelReservation", request.ReservationId)
+
+	res, err := findReservation(request.ReservationId)
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading reservation")
+		return reservation.NewCancelReservationConfirmation(reservation.CancelReservationStatusRejected), nil
+	}
+	if res == nil {
+		return reservation.NewCancelReservationConfirmation(reservation.CancelReservationStatusRejected), nil
+	}
+	if err := deleteReservation(res.ConnectorId); err != nil {
+		appLogger.WithError(err).Error("Error deleting reservation")
+		return reservation.NewCancelReservationConfirmation(reservation.CancelReservationStatusRejected), nil
+	}
+
+	go releaseReservedConnector(res.ConnectorId)
+
+	return reservation.NewCancelReservationConfirmation(reservation.CancelReservationStatusAccepted), nil
+}
+
+// scheduleReservationExpiry releases the connector once the reservation
+// expires, unless it was used, cancelled or replaced in the meantime.
+func scheduleReservationExpiry(res Reservation) {
+	reservationTimersMu.Lock()
+	defer reservationTimersMu.Unlock()
+	if timer, ok := reservationTimers[res.ReservationId]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(res.ExpiryDate), func() {
+		reservationTimersMu.Lock()
+		if reservationTimers[res.ReservationId] == timer {
+			delete(reservationTimers, res.ReservationId)
+		}
+		reservationTimersMu.Unlock()
+		expireReservation(res)
+	})
+	reservationTimers[res.ReservationId] = timer
+}
+
+func expireReservation(res Reservation) {
+	current, err := getReservation(res.ConnectorId)
+	if err != nil || current == nil || current.ReservationId != res.ReservationId || !current.ExpiryDate.Equal(res.ExpiryDate) {
+		return
+	}
+	if err := deleteReservation(res.ConnectorId); err != nil {
+		appLogger.WithError(err).Error("Error deleting expired reservation")
+		return
+	}
+	appLogger.Infoln("Reservation expired", res.ReservationId, "on connector", res.ConnectorId)
+	releaseReservedConnector(res.ConnectorId)
+}
+
+// releaseReservedConnector makes the connector Available again unless its
+// status changed since it was reserved.
+func releaseReservedConnector(connectorId int) {
+	if connectorStatus(connectorId) == core.ChargePointStatusReserved {
+		setConnectorStatus(connectorId, idleStatus(connectorId), core.NoError)
+	}
+}
+
+// restoreReservations re-arms the expiry timers of the reservations persisted
+// before a restart, replacing the ones already armed.
+func restoreReservations() {
+	reservations, err := listReservations()
+	if err != nil {
+		appLogger.WithError(err).Error("Error restoring reservations")
+		return
+	}
+	for _, res := range reservations {
+		scheduleReservationExpiry(res)
+	}
+}
+
+func reservationKey(connectorId int) string {
+	return fmt.Sprintf("%s%d", reservationKeyPrefix, connectorId)
+}
+
+func getReservation(connectorId int) (*Reservation, error) {
+	var res *Reservation
+	err := db.View(func(txn *badger.Txn) error {
+		r, err := getReservationTX(txn, connectorId)
+		res = r
+		return err
+	})
+	return res, err
+}
+
+func getReservationTX(txn *badger.Txn, connectorId int) (*Reservation, error) {
+	item, err := txn.Get([]byte(reservationKey(connectorId)))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	res := &Reservation{}
+	if err := json.Unmarshal(v, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func setReservationTX(txn *badger.Txn, res Reservation) error {
+	v, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(reservationKey(res.ConnectorId)), v)
+}
+
+func deleteReservation(connectorId int) error {
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(reservationKey(connectorId)))
+	})
+}
+
+func listReservations() ([]Reservation, error) {
+	reservations := []Reservation{}
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(reservationKeyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !strings.HasPrefix(string(item.Key()), reservationKeyPrefix) {
+				continue
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			res := Reservation{}
+			if err := json.Unmarshal(v, &res); err != nil {
+				return err
+			}
+			reservations = append(reservations, res)
+		}
+		return nil
+	})
+	return reservations, err
+}
+
+func findReservation(reservationId int) (*Reservation, error) {
+	reservations, err := listReservations()
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range reservations {
+		if res.ReservationId == reservationId {
+			return &res, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+)
+
+const (
+	// hardResetDelay simulates the time the charge point is powered off
+	hardResetDelay = 10 * time.Second
+
+	resetRetryInterval = 5 * time.Second
+
+	// resetFlushTimeout bounds how long a reset waits for the queued
+	// transaction messages to be delivered
+	resetFlushTimeout = 10 * time.Second
+)
+
+var resetInProgress atomic.Bool
+
+func (handler *ChargePointHandler) OnReset(request *core.ResetRequest) (confirmation *core.ResetConfirmation, err error) {
+	appLogger.Println("OnReset", request.Type)
+
+	if request.Type != core.ResetTypeSoft && request.Type != core.ResetTypeHard {
+		return core.NewResetConfirmation(core.ResetStatusRejected), nil
+	}
+	if !resetInProgress.CompareAndSwap(false, true) {
+		appLogger.Println("Reset already in progress")
+		return core.NewResetConfirmation(core.ResetStatusRejected), nil
+	}
+
+	afterConfirmation(func() {
+		defer resetInProgress.Store(false)
+		resetCharger(request.Type)
+	})
+
+	return core.NewResetConfirmation(core.ResetStatusAccepted), nil
+}
+
+// resetCharger stops the running transactions and restarts the charge point,
+// a Hard reset also loses the volatile state and takes a while to power up
+// again. Restarting is attempted ResetRetries more times when it fails.
+func resetCharger(resetType core.ResetType) {
+	reason := core.ReasonSoftReset
+	if resetType == core.ResetTypeHard {
+		reason = core.ReasonHardReset
+	}
+
+	for id := 1; id <= numberOfConnectors(); id++ {
+		if !isTxRunning(id) {
+			continue
+		}
+		if err := stopTransaction(id, reason); err != nil {
+			appLogger.WithError(err).Error("Error stopping transaction on connector ", id)
+		}
+		if resetType == core.ResetTypeSoft {
+			handler.StopRemoteScenario(id)
+		}
+		resetCurrentTx(id)
+	}
+	if chargePoint.IsConnected() && !waitForTransactionMessages(resetFlushTimeout) {
+		appLogger.Println("Transaction messages still queued, they are sent after the reset")
+	}
+
+	sendSecurityEvent("ResetOrReboot", string(resetType)+" reset")
+
+	if chargePoint.IsConnected() {
+		closeStopC()
+		chargePoint.Stop()
+		setConnectionState(ConnectionStateDisconnected, 0, nil)
+	}
+	forgetRegistration()
+	appLogger.Infoln("Charge Point stopped for", resetType, "reset")
+
+	if resetType == core.ResetTypeHard {
+		dropVolatileState()
+		time.Sleep(hardResetDelay)
+	}
+
+	retries := MustGetIntKey("ResetRetries")
+	for attempt := 0; ; attempt++ {
+		err := bootCharger()
+		if err == nil {
+			return
+		}
+		appLogger.WithError(err).WithField("attempt", attempt+1).Error("Error restarting charger")
+		if attempt >= retries {
+			go superviseConnection(err)
+			return
+		}
+		time.Sleep(resetRetryInterval)
+	}
+}
+
+// dropVolatileState forgets what a charge point loses on a power cycle: the
+// message journal, the running log upload and the transient connector
+// statuses.
+func dropVolatileState() {
+	messageJournal.Clear()
+	currentLogUpload.Store(0)
+	db.Update(func(txn *badger.Txn) error {
+		for id := 0; id <= numberOfConnectors(); id++ {
+			switch connectorStatus(id) {
+			case core.ChargePointStatusFaulted, core.ChargePointStatusReserved:
+				continue
+			}
+			txn.Set([]byte(connectorStatusKey(id)), []byte(idleStatus(id)))
+			txn.Set([]byte(connectorErrorCodeKey(id)), []byte(core.NoError))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+// plugInDelay is the time the driver takes to plug the EV in after tapping
+const plugInDelay = 2 * time.Second
+
+var errIdTagNotAccepted = errors.New("idTag not accepted")
+
+// tapIdTag simulates presenting an RFID card on the connector: the idTag is
+// authorized and, once the EV is plugged in, a locally initiated transaction
+// is started. Tapping the idTag of the running transaction stops it.
+func tapIdTag(connectorId int, idTag string) (*types.IdTagInfo, error) {
+	if connectorId <= 0 || connectorId > numberOfConnectors() {
+		return nil, fmt.Errorf("unknown connector %d", connectorId)
+	}
+	if idTag == "" {
+		return nil, errors.New("idTag is required")
+	}
+
+	if isTxRunning(connectorId) {
+		if currentTxIdTag(connectorId) != idTag {
+			return nil, fmt.Errorf("transaction running on connector %d", connectorId)
+		}
+		if err := stopTransaction(connectorId, core.ReasonLocal); err != nil {
+			return nil, err
+		}
+		go func() {
+			handler.StopRemoteScenario(connectorId)
+			resetCurrentTx(connectorId)
+		}()
+		return &types.IdTagInfo{Status: types.AuthorizationStatusAccepted}, nil
+	}
+	if !isOperative(connectorId) {
+		return nil, fmt.Errorf("connector %d is inoperative", connectorId)
+	}
+	if !isRegistered() {
+		return nil, errNotRegistered
+	}
+
+	info, err := authorizeIdTagSync(idTag)
+	if err != nil {
+		return nil, err
+	}
+	appLogger.WithField("idTag", idTag).WithField("connectorId", connectorId).Println("idTag tapped", info.Status)
+	if info.Status != types.AuthorizationStatusAccepted {
+		return info, errIdTagNotAccepted
+	}
+
+	res, err := getReservation(connectorId)
+	if err != nil {
+		return info, err
+	}
+	if res != nil && res.Expired() {
+		res = nil
+	}
+	if res != nil && res.IdTag != idTag && (res.ParentIdTag == "" || res.ParentIdTag != info.ParentIdTag) {
+		return info, fmt.Errorf("connector %d is reserved for another idTag", connectorId)
+	}
+
+	go func() {
+		if err := setConnectorStatus(connectorId, core.ChargePointStatusPreparing, core.NoError); err != nil {
+			return
+		}
+		time.Sleep(plugInDelay)
+		if err := startTransaction(connectorId, idTag, res, nil); err != nil {
+			appLogger.WithError(err).Error("Error starting transaction")
+		}
+	}()
+	return info, nil
+}
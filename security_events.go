@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/security"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+	"github.com/lorenzodonini/ocpp-go/ws"
+)
+
+const securityEventPrefix = "security_event__"
+
+// securityEventsC wakes up the security events sender, it is buffered so that
+// queueing never blocks.
+var securityEventsC = make(chan struct{}, 1)
+
+// SecurityEvent is a security event waiting to be sent to the central system.
+type SecurityEvent struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	TechInfo  string    `json:"techInfo,omitempty"`
+}
+
+// sendSecurityEvent records a security event in the security log and queues
+// its notification, see the OCPP 1.6 security whitepaper for the event types.
+// Events raised while offline are sent once the charge point is connected.
+func sendSecurityEvent(eventType, techInfo string) {
+	now := clockNow()
+	securityLog.Add(now, strings.TrimSpace(eventType+" "+techInfo))
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := IncrementKeyTX(txn, "security_event_seq", 1); err != nil {
+			return err
+		}
+		seq, err := GetIntKeyTX(txn, "security_event_seq")
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(SecurityEvent{Type: eventType, Timestamp: now, TechInfo: techInfo})
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(fmt.Sprintf("%s%010d", securityEventPrefix, seq)), data)
+	}); err != nil {
+		appLogger.WithError(err).Error("Error queueing security event ", eventType)
+		return
+	}
+
+	flushSecurityEvents()
+}
+
+// flushSecurityEvents asks the sender to send the queued security events.
+func flushSecurityEvents() {
+	select {
+	case securityEventsC <- struct{}{}:
+	default:
+	}
+}
+
+// runSecurityEventsSender sends the queued security events in order, stopping
+// at the first failure until it is woken up again.
+func runSecurityEventsSender() {
+	for range securityEventsC {
+		for chargePoint != nil && chargePoint.IsConnected() && isRegistered() {
+			key, event, ok := FirstQueuedValue[SecurityEvent](securityEventPrefix)
+			if !ok {
+				break
+			}
+			req := security.NewSecurityEventNotificationRequest(event.Type, types.NewDateTime(event.Timestamp))
+			req.TechInfo = event.TechInfo
+			if _, err := chargePoint.SendRequest(req); err != nil {
+				appLogger.WithError(err).Error("Error sending SecurityEventNotification ", event.Type)
+				break
+			}
+			appLogger.Println("SecurityEventNotification", event.Type, event.TechInfo)
+			db.Update(func(txn *badger.Txn) error {
+				return txn.Delete(key)
+			})
+		}
+	}
+}
+
+// connectionSecurityEvent reports the security event caused by a failed
+// connection to the central system, if any.
+func connectionSecurityEvent(err error) {
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var httpErr ws.HttpConnectionError
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority),
+		errors.As(err, &invalidCert), errors.As(err, &hostnameErr):
+		sendSecurityEvent("InvalidCentralSystemCertificate", err.Error())
+	case errors.As(err, &httpErr) && httpErr.HttpCode == http.StatusUnauthorized:
+		sendSecurityEvent("FailedToAuthenticateAtCentralSystem", err.Error())
+	}
+}
@@ -1,74 +1,111 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
 	"github.com/dgraph-io/badger/v4"
-	"github.com/lorenzodonini/ocpp-go/ocpp"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/certificates"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/extendedtriggermessage"
-	"github.com/lorenzodonini/ocpp-go/ocpp1.6/logging"
-	"github.com/lorenzodonini/ocpp-go/ocpp1.6/securefirmware"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/security"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
-	"github.com/lorenzodonini/ocpp-go/ocppj"
 )
 
 func (handler *ChargePointHandler) OnInstallCertificate(request *certificates.InstallCertificateRequest) (response *certificates.InstallCertificateResponse, err error) {
-	appLogger.Println("InstallCertificate")
+	appLogger.Println("InstallCertificate", request.CertificateType)
 
-	if request.CertificateType == types.ManufacturerRootCertificate {
-		appLogger.Println("Charge point does not support ManufacturerRootCertificate installation")
+	if request.CertificateType != types.CentralSystemRootCertificate && request.CertificateType != types.ManufacturerRootCertificate {
+		return certificates.NewInstallCertificateResponse(certificates.CertificateStatusRejected), nil
+	}
+	if _, err := parseCertificatePEM(request.Certificate); err != nil {
+		appLogger.WithError(err).Errorf("failed to install certificate")
 		return certificates.NewInstallCertificateResponse(certificates.CertificateStatusRejected), nil
 	}
 
 	if err := db.Update(func(txn *badger.Txn) error {
-		certMaxStoreL, err := GetIntKeyTX(txn, "CertificateStoreMaxLength")
-		if err != nil {
-			return err
-		}
-		rootCertificate, err := GetKeyValueTX(txn, "root_certificate")
-		if err != nil {
-			return err
-		}
-		hasRootCertificate := rootCertificate != ""
-		if hasRootCertificate && certMaxStoreL == 1 {
-			appLogger.Println("no more space to install more certificates")
-			return ocpp.NewError(ocppj.SecurityError, "no more space to install more certificates", "")
-		}
-		return txn.Set([]byte("root_certificate"), []byte(request.Certificate))
+		return installCertificateTX(txn, request.CertificateType, request.Certificate)
 	}); err != nil {
 		appLogger.WithError(err).Errorf("failed to install certificate")
-		return certificates.NewInstallCertificateResponse(certificates.CertificateStatusRejected), err
+		if errors.Is(err, errCertificateStoreFull) || errors.Is(err, errNotRootCertificate) {
+			return certificates.NewInstallCertificateResponse(certificates.CertificateStatusRejected), nil
+		}
+		return certificates.NewInstallCertificateResponse(certificates.CertificateStatusFailed), nil
 	}
 
 	return certificates.NewInstallCertificateResponse(certificates.CertificateStatusAccepted), nil
 }
 
 func (handler *ChargePointHandler) OnGetInstalledCertificateIds(request *certificates.GetInstalledCertificateIdsRequest) (response *certificates.GetInstalledCertificateIdsResponse, err error) {
-	appLogger.Println("GetInstalledCertificateIds")
-	return certificates.NewGetInstalledCertificateIdsResponse(certificates.GetInstalledCertificateStatusAccepted), nil
+	appLogger.Println("GetInstalledCertificateIds", request.CertificateType)
+
+	var installed []InstalledCertificate
+	if err := db.View(func(txn *badger.Txn) error {
+		installed, err = listInstalledCertificatesTX(txn, request.CertificateType)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if len(installed) == 0 {
+		return certificates.NewGetInstalledCertificateIdsResponse(certificates.GetInstalledCertificateStatusNotFound), nil
+	}
+
+	response = certificates.NewGetInstalledCertificateIdsResponse(certificates.GetInstalledCertificateStatusAccepted)
+	for _, c := range installed {
+		response.CertificateHashData = append(response.CertificateHashData, c.HashData)
+	}
+	return response, nil
 }
 
 func (handler *ChargePointHandler) OnDeleteCertificate(request *certificates.DeleteCertificateRequest) (response *certificates.DeleteCertificateResponse, err error) {
-	appLogger.Println("GetBaseReport")
+	appLogger.Println("DeleteCertificate", request.CertificateHashData.SerialNumber)
+
+	err = db.Update(func(txn *badger.Txn) error {
+		return deleteCertificateTX(txn, request.CertificateHashData)
+	})
+	switch {
+	case errors.Is(err, errCertificateNotFound):
+		return certificates.NewDeleteCertificateResponse(certificates.DeleteCertificateStatusNotFound), nil
+	case err != nil:
+		appLogger.WithError(err).Println("failed to delete certificate")
+		return certificates.NewDeleteCertificateResponse(certificates.DeleteCertificateStatusFailed), nil
+	}
 	return certificates.NewDeleteCertificateResponse(certificates.DeleteCertificateStatusAccepted), nil
 }
 
-func (handler *ChargePointHandler) OnGetLog(request *logging.GetLogRequest) (response *logging.GetLogResponse, err error) {
-	appLogger.Println("GetLog")
-	return logging.NewGetLogResponse(logging.LogStatusAccepted), nil
-}
+func (handler *ChargePointHandler) OnExtendedTriggerMessage(request *extendedtriggermessage.ExtendedTriggerMessageRequest) (response *extendedtriggermessage.ExtendedTriggerMessageResponse, err error) {
+	appLogger.Println("ExtendedTriggerMessage", request.RequestedMessage, request.ConnectorId)
 
-func (handler *ChargePointHandler) OnSignedUpdateFirmware(request *securefirmware.SignedUpdateFirmwareRequest) (response *securefirmware.SignedUpdateFirmwareResponse, err error) {
-	appLogger.Println("SignedUpdateFirmware")
-	return securefirmware.NewSignedUpdateFirmwareResponse(securefirmware.UpdateFirmwareStatusAccepted), nil
-}
+	action, send, err := extendedTriggeredMessage(string(request.RequestedMessage), request.ConnectorId)
+	if err != nil {
+		appLogger.WithError(err).Println("ExtendedTriggerMessage not accepted", request.RequestedMessage)
+		if errors.Is(err, errTriggerNotImplemented) {
+			return extendedtriggermessage.NewExtendedTriggerMessageResponse(extendedtriggermessage.ExtendedTriggerMessageStatusNotImplemented), nil
+		}
+		return extendedtriggermessage.NewExtendedTriggerMessageResponse(extendedtriggermessage.ExtendedTriggerMessageStatusRejected), nil
+	}
 
-func (handler *ChargePointHandler) OnExtendedTriggerMessage(request *extendedtriggermessage.ExtendedTriggerMessageRequest) (response *extendedtriggermessage.ExtendedTriggerMessageResponse, err error) {
-	appLogger.Println("ExtendedTriggerMessage")
+	sendTriggeredMessage(action, send)
 	return extendedtriggermessage.NewExtendedTriggerMessageResponse(extendedtriggermessage.ExtendedTriggerMessageStatusAccepted), nil
 }
 
 func (handler *ChargePointHandler) OnCertificateSigned(request *security.CertificateSignedRequest) (response *security.CertificateSignedResponse, err error) {
 	appLogger.Println("CertificateSigned")
+
+	if err := acceptSignedCertificate(request.CertificateChain); err != nil {
+		appLogger.WithError(err).Println("Signed certificate rejected")
+		sendSecurityEvent("InvalidChargePointCertificate", err.Error())
+		return security.NewCertificateSignedResponse(security.CertificateSignedStatusRejected), nil
+	}
+
+	appLogger.Println("ChargePointCertificate installed, used from the next connection")
 	return security.NewCertificateSignedResponse(security.CertificateSignedStatusAccepted), nil
 }
+
+func parseCertificatePEM(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/securefirmware"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+func (handler *ChargePointHandler) OnSignedUpdateFirmware(request *securefirmware.SignedUpdateFirmwareRequest) (response *securefirmware.SignedUpdateFirmwareResponse, err error) {
+	fw := request.Firmware
+	appLogger.Println("SignedUpdateFirmware", request.RequestID, fw.Location, fw.RetrieveDateTime)
+
+	signingCert, err := verifyFirmwareSigningCertificate(fw.SigningCertificate)
+	if err != nil {
+		appLogger.WithError(err).Println("Invalid firmware signing certificate")
+		sendSecurityEvent("InvalidFirmwareSigningCertificate", err.Error())
+		return securefirmware.NewSignedUpdateFirmwareResponse(securefirmware.UpdateFirmwareStatusInvalidCertificate), nil
+	}
+
+	if !firmwareUpdateInProgress.CompareAndSwap(false, true) {
+		appLogger.Println("Firmware update already in progress")
+		return securefirmware.NewSignedUpdateFirmwareResponse(securefirmware.UpdateFirmwareStatusRejected), nil
+	}
+
+	retrieveDate, installDate := time.Now(), time.Now()
+	if fw.RetrieveDateTime != nil {
+		retrieveDate = fw.RetrieveDateTime.Time
+	}
+	if fw.InstallDateTime != nil {
+		installDate = fw.InstallDateTime.Time
+	}
+	retries, retryInterval := transferRetries(request.Retries, request.RetryInterval)
+
+	afterConfirmation(func() {
+		defer firmwareUpdateInProgress.Store(false)
+		signedUpdateFirmware(request.RequestID, fw, signingCert, retrieveDate, installDate,
+			retries, retryInterval)
+	})
+
+	return securefirmware.NewSignedUpdateFirmwareResponse(securefirmware.UpdateFirmwareStatusAccepted), nil
+}
+
+func signedUpdateFirmware(requestId int, fw securefirmware.Firmware, signingCert *x509.Certificate, retrieveDate, installDate time.Time, retries int, retryInterval time.Duration) {
+	if time.Now().Before(retrieveDate) {
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusDownloadScheduled, requestId)
+		time.Sleep(time.Until(retrieveDate))
+	}
+
+	var data []byte
+	if err := withRetries("Firmware download", fw.Location, retries, retryInterval, func() (err error) {
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusDownloading, requestId)
+		data, err = downloadFile(fw.Location)
+		return err
+	}); err != nil {
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusDownloadFailed, requestId)
+		return
+	}
+	setSignedFirmwareStatus(securefirmware.FirmwareStatusDownloaded, requestId)
+
+	if err := verifyFirmwareSignature(data, fw.Signature, signingCert); err != nil {
+		appLogger.WithError(err).Error("Firmware signature verification failed")
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusInvalidSignature, requestId)
+		sendSecurityEvent("InvalidFirmwareSignature", err.Error())
+		return
+	}
+	setSignedFirmwareStatus(securefirmware.FirmwareStatusSignatureVerified, requestId)
+
+	if time.Now().Before(installDate) {
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusInstallScheduled, requestId)
+		time.Sleep(time.Until(installDate))
+	}
+	waitForTxEnd()
+	setSignedFirmwareStatus(securefirmware.FirmwareStatusInstalling, requestId)
+
+	version, err := storeFirmware(fw.Location, data)
+	if err != nil {
+		appLogger.WithError(err).Error("Firmware installation failed")
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusInstallVerificationFailed, requestId)
+		return
+	}
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("signed_firmware_installed_pending"), []byte(strconv.Itoa(requestId)))
+	}); err != nil {
+		appLogger.WithError(err).Error("Firmware installation failed")
+		setSignedFirmwareStatus(securefirmware.FirmwareStatusInstallationFailed, requestId)
+		return
+	}
+
+	setSignedFirmwareStatus(securefirmware.FirmwareStatusInstallRebooting, requestId)
+	appLogger.Infoln("Firmware", version, "installed, rebooting")
+	if err := rebootCharger(); err != nil {
+		appLogger.WithError(err).Error("Error rebooting charger")
+	}
+}
+
+// verifyFirmwareSigningCertificate parses the signing certificate and checks
+// it was issued under one of the installed ManufacturerRootCertificates.
+func verifyFirmwareSigningCertificate(signingCertificate string) (*x509.Certificate, error) {
+	cert, err := parseCertificatePEM(signingCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := certificatePool(types.ManufacturerRootCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// verifyFirmwareSignature checks the base64 encoded signature of the SHA-256
+// digest of the firmware image.
+func verifyFirmwareSignature(data []byte, signature string, cert *x509.Certificate) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest := sha256.Sum256(data)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return errors.New("ecdsa signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing key type %T", cert.PublicKey)
+}
+
+// setSignedFirmwareStatus reports the status of a signed firmware update, see
+// currentSignedFirmwareStatus.
+func setSignedFirmwareStatus(status securefirmware.FirmwareStatus, requestId int) {
+	req := securefirmware.NewSignedFirmwareStatusNotificationRequest(status)
+	req.RequestID = &requestId
+	if _, err := chargePoint.SendRequest(req); err != nil {
+		appLogger.WithError(err).Error("Error sending SignedFirmwareStatusNotification ", status)
+	} else {
+		appLogger.Println("SignedFirmwareStatusNotification", status, requestId)
+	}
+
+	switch status {
+	case securefirmware.FirmwareStatusDownloadFailed,
+		securefirmware.FirmwareStatusInvalidSignature,
+		securefirmware.FirmwareStatusInstallVerificationFailed,
+		securefirmware.FirmwareStatusInstallationFailed,
+		securefirmware.FirmwareStatusInstalled:
+		status = securefirmware.FirmwareStatusIdle
+	}
+	db.Update(func(txn *badger.Txn) error {
+		txn.Set([]byte("signed_firmware_status"), []byte(status))
+		return txn.Set([]byte("signed_firmware_request_id"), []byte(strconv.Itoa(requestId)))
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/smartcharging"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const chargingProfileKeyPrefix = "charging_profile__"
+
+type StoredChargingProfile struct {
+	ConnectorId int                    `json:"connector_id"`
+	Profile     *types.ChargingProfile `json:"profile"`
+}
+
+func (handler *ChargePointHandler) OnSetChargingProfile(request *smartcharging.SetChargingProfileRequest) (confirmation *smartcharging.SetChargingProfileConfirmation, err error) {
+	connectorId := request.ConnectorId
+	profile := request.ChargingProfile
+	if profile == nil || profile.ChargingSchedule == nil {
+		return smartcharging.NewSetChargingProfileConfirmation(smartcharging.ChargingProfileStatusRejected), nil
+	}
+	appLogger.Println("OnSetChargingProfile", connectorId, profile.ChargingProfileId,
+		profile.ChargingProfilePurpose, profile.StackLevel)
+
+	if err := validateChargingProfile(connectorId, profile); err != nil {
+		appLogger.WithError(err).
+			WithField("connectorId", connectorId).
+			WithField("chargingProfileId", profile.ChargingProfileId).
+			Println("Charging profile rejected")
+		return smartcharging.NewSetChargingProfileConfirmation(smartcharging.ChargingProfileStatusRejected), nil
+	}
+
+	if err := installChargingProfile(connectorId, profile); err != nil {
+		appLogger.WithError(err).Println("Error storing charging profile")
+		return smartcharging.NewSetChargingProfileConfirmation(smartcharging.ChargingProfileStatusRejected), nil
+	}
+
+	return smartcharging.NewSetChargingProfileConfirmation(smartcharging.ChargingProfileStatusAccepted), nil
+}
+
+func (handler *ChargePointHandler) OnClearChargingProfile(request *smartcharging.ClearChargingProfileRequest) (confirmation *smartcharging.ClearChargingProfileConfirmation, err error) {
+	appLogger.Println("OnClearChargingProfile", request.Id, request.ConnectorId,
+		request.ChargingProfilePurpose, request.StackLevel)
+
+	cleared := 0
+	if err := db.Update(func(txn *badger.Txn) error {
+		profiles, err := listChargingProfilesTX(txn)
+		if err != nil {
+			return err
+		}
+		for _, p := range profiles {
+			if !matchesClearRequest(p, request) {
+				continue
+			}
+			if err := txn.Delete([]byte(chargingProfileKey(p.Profile.ChargingProfileId))); err != nil {
+				return err
+			}
+			cleared++
+		}
+		return nil
+	}); err != nil {
+		appLogger.WithError(err).Error("Error clearing charging profiles")
+		return smartcharging.NewClearChargingProfileConfirmation(smartcharging.ClearChargingProfileStatusUnknown), nil
+	}
+
+	if cleared == 0 {
+		return smartcharging.NewClearChargingProfileConfirmation(smartcharging.ClearChargingProfileStatusUnknown), nil
+	}
+	return smartcharging.NewClearChargingProfileConfirmation(smartcharging.ClearChargingProfileStatusAccepted), nil
+}
+
+func (handler *ChargePointHandler) OnGetCompositeSchedule(request *smartcharging.GetCompositeScheduleRequest) (confirmation *smartcharging.GetCompositeScheduleConfirmation, err error) {
+	connectorId := request.ConnectorId
+	appLogger.Println("OnGetCompositeSchedule", connectorId, request.Duration, request.ChargingRateUnit)
+
+	if connectorId < 0 || connectorId > numberOfConnectors() || request.Duration <= 0 {
+		return smartcharging.NewGetCompositeScheduleConfirmation(smartcharging.GetCompositeScheduleStatusRejected), nil
+	}
+
+	unit := request.ChargingRateUnit
+	if unit == "" {
+		unit = types.ChargingRateUnitAmperes
+	}
+	if !isChargingRateUnitAllowed(unit) {
+		return smartcharging.NewGetCompositeScheduleConfirmation(smartcharging.GetCompositeScheduleStatusRejected), nil
+	}
+
+	profiles, err := listChargingProfiles()
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading charging profiles")
+		return smartcharging.NewGetCompositeScheduleConfirmation(smartcharging.GetCompositeScheduleStatusRejected), nil
+	}
+
+	now := time.Now()
+	schedule := compositeSchedule(profiles, connectorId, now, request.Duration, unit, txStartedAt(connectorId, now))
+
+	confirmation = smartcharging.NewGetCompositeScheduleConfirmation(smartcharging.GetCompositeScheduleStatusAccepted)
+	confirmation.ConnectorId = &connectorId
+	confirmation.ScheduleStart = types.NewDateTime(now)
+	confirmation.ChargingSchedule = schedule
+	return confirmation, nil
+}
+
+// installChargingProfile stores a validated charging profile, replacing the
+// profile it supersedes.
+func installChargingProfile(connectorId int, profile *types.ChargingProfile) error {
+	return db.Update(func(txn *badger.Txn) error {
+		profiles, err := listChargingProfilesTX(txn)
+		if err != nil {
+			return err
+		}
+
+		installed := 0
+		for _, p := range profiles {
+			// a profile with the same id, or the same purpose and stack level on
+			// the same connector, is replaced by the new one
+			replaced := p.Profile.ChargingProfileId == profile.ChargingProfileId ||
+				(p.ConnectorId == connectorId &&
+					p.Profile.ChargingProfilePurpose == profile.ChargingProfilePurpose &&
+					p.Profile.StackLevel == profile.StackLevel)
+			if replaced {
+				if err := txn.Delete([]byte(chargingProfileKey(p.Profile.ChargingProfileId))); err != nil {
+					return err
+				}
+				continue
+			}
+			installed++
+		}
+
+		maxInstalled := MustGetIntKeyTX(txn, "MaxChargingProfilesInstalled")
+		if maxInstalled > 0 && installed >= maxInstalled {
+			return fmt.Errorf("maximum of %d installed charging profiles reached", maxInstalled)
+		}
+
+		return setChargingProfileTX(txn, StoredChargingProfile{
+			ConnectorId: connectorId,
+			Profile:     profile,
+		})
+	})
+}
+
+func validateChargingProfile(connectorId int, profile *types.ChargingProfile) error {
+	if connectorId < 0 || connectorId > numberOfConnectors() {
+		return fmt.Errorf("unknown connector %d", connectorId)
+	}
+
+	switch profile.ChargingProfilePurpose {
+	case types.ChargingProfilePurposeChargePointMaxProfile:
+		if connectorId != 0 {
+			return fmt.Errorf("%s can only be set on connector 0", profile.ChargingProfilePurpose)
+		}
+	case types.ChargingProfilePurposeTxDefaultProfile:
+	case types.ChargingProfilePurposeTxProfile:
+		if connectorId == 0 {
+			return fmt.Errorf("%s cannot be set on connector 0", profile.ChargingProfilePurpose)
+		}
+		if !isTxRunning(connectorId) {
+			return fmt.Errorf("no transaction running on connector %d", connectorId)
+		}
+		if profile.TransactionId != 0 && profile.TransactionId != currentTxId(connectorId) {
+			return fmt.Errorf("transaction %d is not running", profile.TransactionId)
+		}
+	default:
+		return fmt.Errorf("unknown charging profile purpose %s", profile.ChargingProfilePurpose)
+	}
+	return validateChargingSchedule(profile)
+}
+
+// validateChargingSchedule checks the kind, stack level and schedule of the
+// profile whatever its purpose.
+func validateChargingSchedule(profile *types.ChargingProfile) error {
+	schedule := profile.ChargingSchedule
+
+	switch profile.ChargingProfileKind {
+	case types.ChargingProfileKindAbsolute, types.ChargingProfileKindRelative:
+	case types.ChargingProfileKindRecurring:
+		if profile.RecurrencyKind == "" || schedule.StartSchedule == nil {
+			return fmt.Errorf("recurring profiles require a recurrency kind and a start schedule")
+		}
+	default:
+		return fmt.Errorf("unknown charging profile kind %s", profile.ChargingProfileKind)
+	}
+
+	maxStackLevel := MustGetIntKey("ChargeProfileMaxStackLevel")
+	if profile.StackLevel < 0 || profile.StackLevel > maxStackLevel {
+		return fmt.Errorf("stack level %d exceeds the maximum of %d", profile.StackLevel, maxStackLevel)
+	}
+
+	maxPeriods := MustGetIntKey("ChargingScheduleMaxPeriods")
+	if len(schedule.ChargingSchedulePeriod) == 0 || len(schedule.ChargingSchedulePeriod) > maxPeriods {
+		return fmt.Errorf("schedule must have between 1 and %d periods", maxPeriods)
+	}
+
+	if !isChargingRateUnitAllowed(schedule.ChargingRateUnit) {
+		return fmt.Errorf("charging rate unit %s is not allowed", schedule.ChargingRateUnit)
+	}
+	return nil
+}
+
+func matchesClearRequest(p StoredChargingProfile, request *smartcharging.ClearChargingProfileRequest) bool {
+	if request.Id != nil {
+		return p.Profile.ChargingProfileId == *request.Id
+	}
+	if request.ConnectorId != nil && p.ConnectorId != *request.ConnectorId {
+		return false
+	}
+	if request.ChargingProfilePurpose != "" && p.Profile.ChargingProfilePurpose != request.ChargingProfilePurpose {
+		return false
+	}
+	if request.StackLevel != nil && p.Profile.StackLevel != *request.StackLevel {
+		return false
+	}
+	return true
+}
+
+func isChargingRateUnitAllowed(unit types.ChargingRateUnitType) bool {
+	allowed, _ := GetKeyValue("ChargingScheduleAllowedChargingRateUnit")
+	for _, v := range strings.Split(allowed, ",") {
+		switch strings.TrimSpace(v) {
+		case "Current":
+			if unit == types.ChargingRateUnitAmperes {
+				return true
+			}
+		case "Power":
+			if unit == types.ChargingRateUnitWatts {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func chargingProfileKey(profileId int) string {
+	return fmt.Sprintf("%s%d", chargingProfileKeyPrefix, profileId)
+}
+
+func setChargingProfileTX(txn *badger.Txn, p StoredChargingProfile) error {
+	v, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(chargingProfileKey(p.Profile.ChargingProfileId)), v)
+}
+
+func listChargingProfiles() ([]StoredChargingProfile, error) {
+	var profiles []StoredChargingProfile
+	err := db.View(func(txn *badger.Txn) error {
+		p, err := listChargingProfilesTX(txn)
+		profiles = p
+		return err
+	})
+	return profiles, err
+}
+
+func listChargingProfilesTX(txn *badger.Txn) ([]StoredChargingProfile, error) {
+	profiles := []StoredChargingProfile{}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(chargingProfileKeyPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		v, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		p := StoredChargingProfile{}
+		if err := json.Unmarshal(v, &p); err != nil {
+			return nil, err
+		}
+		if p.Profile == nil || p.Profile.ChargingSchedule == nil {
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// deleteTxProfilesTX removes the TxProfiles of a connector, they only live as
+// long as the transaction they were set for.
+func deleteTxProfilesTX(txn *badger.Txn, connectorId int) error {
+	profiles, err := listChargingProfilesTX(txn)
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		if p.ConnectorId != connectorId || p.Profile.ChargingProfilePurpose != types.ChargingProfilePurposeTxProfile {
+			continue
+		}
+		if err := txn.Delete([]byte(chargingProfileKey(p.Profile.ChargingProfileId))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/lorenzodonini/ocpp-go/ocpp"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+const (
+	txMessagePrefix = "tx_message__"
+	txIdMapPrefix   = "transaction_id__"
+
+	// txMessagesPollInterval is how often waitForTransactionMessages checks
+	// whether the queue was drained
+	txMessagesPollInterval = 500 * time.Millisecond
+)
+
+// txMessagesC wakes up the transaction messages sender, it is buffered so
+// that queueing never blocks.
+var txMessagesC = make(chan struct{}, 1)
+
+// TransactionMessage is a StartTransaction, StopTransaction or MeterValues
+// request waiting to be delivered to the central system. Transactions start
+// with a local id, the id assigned by the central system replaces it when the
+// request is sent.
+type TransactionMessage struct {
+	Action      string                 `json:"action"`
+	ConnectorId int                    `json:"connectorId"`
+	LocalTxId   int                    `json:"localTxId"`
+	Request     json.RawMessage        `json:"request"`
+	Profile     *types.ChargingProfile `json:"profile,omitempty"`
+	Attempts    int                    `json:"attempts"`
+}
+
+// queueTransactionMessage appends the request of the transaction to the
+// queue, it is delivered in order once the charge point is connected. profile
+// is the TxProfile to install when a StartTransaction is accepted.
+func queueTransactionMessage(connectorId, localTxId int, req ocpp.Request, profile *types.ChargingProfile) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(TransactionMessage{
+		Action:      req.GetFeatureName(),
+		ConnectorId: connectorId,
+		LocalTxId:   localTxId,
+		Request:     data,
+		Profile:     profile,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := db.Update(func(txn *badger.Txn) error {
+		if err := IncrementKeyTX(txn, "tx_message_seq", 1); err != nil {
+			return err
+		}
+		seq, err := GetIntKeyTX(txn, "tx_message_seq")
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(fmt.Sprintf("%s%010d", txMessagePrefix, seq)), msg)
+	}); err != nil {
+		return err
+	}
+
+	flushTransactionMessages()
+	return nil
+}
+
+// flushTransactionMessages asks the sender to deliver the queued transaction
+// messages.
+func flushTransactionMessages() {
+	select {
+	case txMessagesC <- struct{}{}:
+	default:
+	}
+}
+
+// runTransactionMessagesSender delivers the queued transaction messages in
+// order. A message the central system fails to process is retried up to
+// TransactionMessageAttempts times, waiting TransactionMessageRetryInterval
+// multiplied by the attempts made in between, and then dropped. Losing the
+// connection doesn't count as an attempt, the sender waits to be woken up
+// again instead.
+func runTransactionMessagesSender() {
+	for range txMessagesC {
+		for chargePoint != nil && chargePoint.IsConnected() && isRegistered() {
+			key, msg, ok := FirstQueuedValue[TransactionMessage](txMessagePrefix)
+			if !ok {
+				break
+			}
+
+			err := sendTransactionMessage(msg)
+			if err == nil {
+				db.Update(func(txn *badger.Txn) error {
+					return txn.Delete(key)
+				})
+				continue
+			}
+			if !chargePoint.IsConnected() || !isRegistered() {
+				appLogger.WithError(err).Println("Offline, keeping queued", msg.Action)
+				break
+			}
+
+			msg.Attempts++
+			logger := appLogger.WithError(err).
+				WithField("connector_id", msg.ConnectorId).
+				WithField("attempt", msg.Attempts)
+			if msg.Attempts >= max(MustGetIntKey("TransactionMessageAttempts"), 1) {
+				logger.Error("Dropping ", msg.Action)
+				db.Update(func(txn *badger.Txn) error {
+					return txn.Delete(key)
+				})
+				if msg.Action == core.StartTransactionFeatureName {
+					abandonTransaction(msg)
+				}
+				continue
+			}
+			logger.Error("Error sending ", msg.Action)
+			data, _ := json.Marshal(msg)
+			db.Update(func(txn *badger.Txn) error {
+				return txn.Set(key, data)
+			})
+			retryInterval := MustGetIntKey("TransactionMessageRetryInterval")
+			time.Sleep(time.Duration(msg.Attempts*retryInterval) * time.Second)
+		}
+	}
+}
+
+// waitForTransactionMessages waits until the queue is drained, giving up after
+// timeout.
+func waitForTransactionMessages(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, _, ok := FirstQueuedValue[TransactionMessage](txMessagePrefix); !ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(txMessagesPollInterval)
+	}
+}
+
+func sendTransactionMessage(msg TransactionMessage) error {
+	switch msg.Action {
+	case core.StartTransactionFeatureName:
+		req := &core.StartTransactionRequest{}
+		if err := json.Unmarshal(msg.Request, req); err != nil {
+			return err
+		}
+		resp, err := chargePoint.SendRequest(req)
+		if err != nil {
+			return err
+		}
+		if conf, ok := resp.(*core.StartTransactionConfirmation); ok {
+			onTransactionStarted(msg, req, conf)
+		}
+
+	case core.StopTransactionFeatureName:
+		req := &core.StopTransactionRequest{}
+		if err := json.Unmarshal(msg.Request, req); err != nil {
+			return err
+		}
+		txId, ok := transactionIdOf(msg.LocalTxId)
+		if !ok {
+			appLogger.Error("Dropping StopTransaction of unknown transaction ", msg.LocalTxId)
+			return nil
+		}
+		req.TransactionId = txId
+		resp, err := chargePoint.SendRequest(req)
+		if err != nil {
+			return err
+		}
+		if conf, ok := resp.(*core.StopTransactionConfirmation); ok && conf.IdTagInfo != nil {
+			updateAuthCache(req.IdTag, conf.IdTagInfo)
+			appLogger.Infoln("Transaction stopped", req.TransactionId, req.Reason, conf.IdTagInfo.Status)
+		}
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(txIdMapKey(msg.LocalTxId)))
+		})
+
+	case core.MeterValuesFeatureName:
+		req := &core.MeterValuesRequest{}
+		if err := json.Unmarshal(msg.Request, req); err != nil {
+			return err
+		}
+		if req.TransactionId != nil {
+			txId, ok := transactionIdOf(msg.LocalTxId)
+			if !ok {
+				appLogger.Error("Dropping MeterValues of unknown transaction ", msg.LocalTxId)
+				return nil
+			}
+			req.TransactionId = &txId
+		}
+		if _, err := chargePoint.SendRequest(req); err != nil {
+			return err
+		}
+
+	default:
+		appLogger.Error("Dropping unknown transaction message ", msg.Action)
+	}
+	return nil
+}
+
+// onTransactionStarted replaces the local id of the transaction with the one
+// assigned by the central system, and installs its TxProfile or handles the
+// invalid idTag while the transaction is still running.
+func onTransactionStarted(msg TransactionMessage, req *core.StartTransactionRequest, conf *core.StartTransactionConfirmation) {
+	connectorId := msg.ConnectorId
+	tagInfo := conf.IdTagInfo
+	updateAuthCache(req.IdTag, tagInfo)
+
+	running := isTxRunning(connectorId) && currentLocalTxId(connectorId) == msg.LocalTxId
+	db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(txIdMapKey(msg.LocalTxId)), []byte(fmt.Sprint(conf.TransactionId))); err != nil {
+			return err
+		}
+		if !running {
+			return nil
+		}
+		return txn.Set([]byte(txKey(connectorId, "id")), []byte(fmt.Sprint(conf.TransactionId)))
+	})
+
+	if tagInfo == nil || tagInfo.Status != types.AuthorizationStatusAccepted {
+		// the charger already started, the transaction exists but the idTag
+		// was not authorized
+		appLogger.Println("Transaction started with an invalid idTag", tagInfo, conf.TransactionId)
+		if running {
+			go handleInvalidIdTag(connectorId, conf.TransactionId)
+		}
+		return
+	}
+
+	appLogger.Infoln("Transaction started", tagInfo.Status, conf.TransactionId)
+	if running && msg.Profile != nil {
+		installTxProfile(connectorId, conf.TransactionId, msg.Profile)
+	}
+}
+
+func txIdMapKey(localTxId int) string {
+	return fmt.Sprintf("%s%d", txIdMapPrefix, localTxId)
+}
+
+// transactionIdOf returns the id the central system assigned to the
+// transaction started with the local id, transactions started before the
+// queue existed already have it. It fails when the central system never
+// assigned one, local ids are not to be sent.
+func transactionIdOf(localTxId int) (int, bool) {
+	if localTxId >= 0 {
+		return localTxId, true
+	}
+	if id, err := GetIntKey(txIdMapKey(localTxId)); err == nil && id != 0 {
+		return id, true
+	}
+	return 0, false
+}
+
+// abandonTransaction ends the transaction whose StartTransaction was dropped,
+// the central system never heard of it so the messages queued for it are
+// dropped as well.
+func abandonTransaction(msg TransactionMessage) {
+	if isTxRunning(msg.ConnectorId) && currentLocalTxId(msg.ConnectorId) == msg.LocalTxId {
+		resetCurrentTx(msg.ConnectorId)
+		go handler.StopRemoteScenario(msg.ConnectorId)
+	}
+	if err := dropTransactionMessages(msg.LocalTxId); err != nil {
+		appLogger.WithError(err).Error("Error dropping the messages of transaction ", msg.LocalTxId)
+	}
+}
+
+// dropTransactionMessages removes the queued messages of the transaction
+// started with the local id.
+func dropTransactionMessages(localTxId int) error {
+	return db.Update(func(txn *badger.Txn) error {
+		keys := [][]byte{}
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(txMessagePrefix)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			var msg TransactionMessage
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &msg)
+			}); err != nil || msg.LocalTxId != localTxId {
+				continue
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// nextLocalTxId returns a new local transaction id, local ids are negative so
+// they never collide with the ones assigned by the central system.
+func nextLocalTxId() (int, error) {
+	var seq int
+	err := db.Update(func(txn *badger.Txn) error {
+		if err := IncrementKeyTX(txn, "local_transaction_seq", 1); err != nil {
+			return err
+		}
+		var err error
+		seq, err = GetIntKeyTX(txn, "local_transaction_seq")
+		return err
+	})
+	return -seq, err
+}
@@ -1,23 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
-	"github.com/lorenzodonini/ocpp-go/ocpp"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
 	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
 )
 
 func (handler *ChargePointHandler) OnRemoteStartTransaction(request *core.RemoteStartTransactionRequest) (confirmation *core.RemoteStartTransactionConfirmation, err error) {
+	// transactions are only allowed once the central system accepted the
+	// charge point
+	if !isRegistered() {
+		appLogger.WithField("registration", registrationStatus()).Println("Charge point not registered")
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
+
 	connectorId := request.ConnectorId
 	if connectorId == nil {
-		val := 1
+		val, ok := freeConnectorId()
+		if !ok {
+			appLogger.WithField("idTag", request.IdTag).Println("No free connector")
+			return core.NewRemoteStartTransactionConfirmation(
+				types.RemoteStartStopStatusRejected), nil
+		}
 		connectorId = &val
 	}
+	if *connectorId <= 0 || *connectorId > numberOfConnectors() {
+		appLogger.WithField("connectorId", *connectorId).Println("Unknown connector")
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
 
-	if isTxRunning() {
+	if !isOperative(*connectorId) {
+		appLogger.WithField("connectorId", *connectorId).Println("Connector is inoperative")
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
+	if isTxRunning(*connectorId) {
 		appLogger.
 			WithField("idTag", request.IdTag).
 			WithField("connectorId", *connectorId).
@@ -27,154 +50,422 @@ func (handler *ChargePointHandler) OnRemoteStartTransaction(request *core.Remote
 			types.RemoteStartStopStatusRejected), err
 	}
 
-	appLogger.Infoln("Starting Transaction", request.IdTag, connectorId)
+	res, err := getReservation(*connectorId)
+	if err != nil {
+		appLogger.WithError(err).Error("Error reading reservation")
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
+	if res != nil && res.Expired() {
+		res = nil
+	}
+	if res != nil && res.IdTag != request.IdTag && res.ParentIdTag == "" {
+		appLogger.
+			WithField("idTag", request.IdTag).
+			WithField("connectorId", *connectorId).
+			WithField("reservationId", res.ReservationId).
+			Println("Connector is reserved for another idTag")
 
-	startEnergyValue := MustGetIntKey(EnergyKey)
-	req := core.NewStartTransactionRequest(*connectorId,
-		request.IdTag,
-		startEnergyValue,
-		types.NewDateTime(time.Now()))
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
+
+	// the charging profile becomes the TxProfile of the transaction once it
+	// started
+	profile := request.ChargingProfile
+	if profile != nil && (profile.ChargingProfilePurpose != types.ChargingProfilePurposeTxProfile || profile.ChargingSchedule == nil) {
+		appLogger.
+			WithField("chargingProfileId", profile.ChargingProfileId).
+			WithField("purpose", profile.ChargingProfilePurpose).
+			Println("RemoteStartTransaction charging profile must be a TxProfile")
+
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
+	if profile != nil {
+		if err := validateChargingSchedule(profile); err != nil {
+			appLogger.
+				WithError(err).
+				WithField("chargingProfileId", profile.ChargingProfileId).
+				Println("Invalid RemoteStartTransaction charging profile")
+
+			return core.NewRemoteStartTransactionConfirmation(
+				types.RemoteStartStopStatusRejected), nil
+		}
+	}
 
-	err = chargePoint.SendRequestAsync(req, func(resp ocpp.Response, protoError error) {
-		if conf, ok := resp.(*core.StartTransactionConfirmation); ok {
-			tagInfo := conf.IdTagInfo
+	appLogger.Infoln("Starting Transaction", request.IdTag, connectorId)
 
-			switch tagInfo.Status {
-			case types.AuthorizationStatusAccepted:
-				setTxIdTag(request.IdTag)
-				setTxId(conf.TransactionId, *connectorId)
+	startTx := func() {
+		if err := startTransaction(*connectorId, request.IdTag, res, profile); err != nil {
+			appLogger.WithError(err).Error("Error starting transaction")
+		}
+	}
 
-				go handler.RunRemoteScenario()
+	groupReservation := res != nil && res.IdTag != request.IdTag
+	if !groupReservation && !MustGetBoolKey("AuthorizeRemoteTxRequests") {
+		startTx()
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusAccepted), nil
+	}
 
-				appLogger.Infoln("Transaction started", tagInfo.Status, conf.TransactionId)
-				return
-			default:
-				appLogger.Println("Transaction won't start", tagInfo.Status)
-			}
+	// with AuthorizeRemoteTxRequests the idTag must be authorized first, and
+	// for a connector reserved for a group the idTag's parent is only known
+	// after authorizing it
+	err = authorizeIdTag(request.IdTag, func(tagInfo *types.IdTagInfo, err error) {
+		if err != nil {
+			appLogger.WithError(err).Println("Error authorizing idTag", request.IdTag)
+			abortRemoteStart(*connectorId)
 			return
 		}
-
-		appLogger.Println("StartTransactionConfirmation", resp, protoError)
+		if tagInfo.Status != types.AuthorizationStatusAccepted {
+			appLogger.
+				WithField("idTag", request.IdTag).
+				WithField("connectorId", *connectorId).
+				Println("Transaction won't start, idTag not authorized", tagInfo.Status)
+			abortRemoteStart(*connectorId)
+			return
+		}
+		if groupReservation && tagInfo.ParentIdTag != res.ParentIdTag {
+			appLogger.
+				WithField("idTag", request.IdTag).
+				WithField("parentIdTag", tagInfo.ParentIdTag).
+				WithField("reservationId", res.ReservationId).
+				Println("Transaction won't start, idTag does not match the reservation")
+			abortRemoteStart(*connectorId)
+			return
+		}
+		startTx()
 	})
+	if err != nil {
+		// offline with an idTag unknown locally, there's nothing to authorize
+		// the transaction with
+		appLogger.WithError(err).Println("Error authorizing idTag", request.IdTag)
+		return core.NewRemoteStartTransactionConfirmation(
+			types.RemoteStartStopStatusRejected), nil
+	}
 
 	return core.NewRemoteStartTransactionConfirmation(
-		types.RemoteStartStopStatusAccepted), err
+		types.RemoteStartStopStatusAccepted), nil
+}
+
+// abortRemoteStart reports the connector idle again after an accepted
+// RemoteStartTransaction failed to authorize its idTag, a reserved connector
+// stays Reserved.
+func abortRemoteStart(connectorId int) {
+	if isTxRunning(connectorId) {
+		return
+	}
+	status := idleStatus(connectorId)
+	if current := connectorStatus(connectorId); current == status || current == core.ChargePointStatusReserved {
+		if err := sendConnectorStatus(connectorId); err != nil {
+			appLogger.WithError(err).Error("Error sending StatusNotification for connector ", connectorId)
+		}
+		return
+	}
+	if err := setIdleStatus(connectorId); err != nil {
+		appLogger.WithError(err).Error("Error changing status of connector ", connectorId)
+	}
 }
 
 func (handler *ChargePointHandler) OnRemoteStopTransaction(request *core.RemoteStopTransactionRequest) (confirmation *core.RemoteStopTransactionConfirmation, err error) {
 	appLogger.Infoln("OnRemoteStopTransaction", request.TransactionId)
 
-	if !isTxRunning() {
-		appLogger.Println("No transaction running")
+	connectorId, ok := txConnectorId(request.TransactionId)
+	if !ok {
+		appLogger.Println("Transaction not running", request.TransactionId)
 		return core.NewRemoteStopTransactionConfirmation(types.RemoteStartStopStatusRejected), nil
 	}
 
-	txId := currentTxId()
-	connectorId := currentTxConnectorId()
+	if err := stopTransaction(connectorId, core.ReasonRemote); err != nil {
+		appLogger.WithError(err).Error("Error queueing StopTransaction ", request.TransactionId)
+		return core.NewRemoteStopTransactionConfirmation(types.RemoteStartStopStatusRejected), nil
+	}
 
-	req := core.NewStopTransactionRequest(connectorId,
-		types.NewDateTime(time.Now()), request.TransactionId)
+	go func() {
+		handler.StopRemoteScenario(connectorId)
+		resetCurrentTx(connectorId)
+	}()
 
-	req.Reason = core.ReasonEVDisconnected
-	req.IdTag = currentTxIdTag()
-	req.MeterStop = MustGetIntKey(EnergyKey)
+	return core.NewRemoteStopTransactionConfirmation(types.RemoteStartStopStatusAccepted), nil
+}
 
-	err = chargePoint.SendRequestAsync(req, func(resp ocpp.Response, protoError error) {
-		if conf, ok := resp.(*core.StopTransactionConfirmation); ok {
-			tagInfo := conf.IdTagInfo
+func (handler *ChargePointHandler) OnUnlockConnector(request *core.UnlockConnectorRequest) (confirmation *core.UnlockConnectorConfirmation, err error) {
+	connectorId := request.ConnectorId
+	appLogger.Println("OnUnlockConnector", connectorId)
 
-			switch tagInfo.Status {
-			case types.AuthorizationStatusAccepted:
+	if connectorId <= 0 || connectorId > numberOfConnectors() {
+		return core.NewUnlockConnectorConfirmation(core.UnlockStatusNotSupported), nil
+	}
 
-				go func() {
-					handler.StopRemoteScenario()
-					resetCurrentTx()
-				}()
+	// unlocking the cable ends the transaction running on the connector
+	if isTxRunning(connectorId) {
+		if err := stopTransaction(connectorId, core.ReasonUnlockCommand); err != nil {
+			appLogger.WithError(err).Error("Error queueing StopTransaction on connector ", connectorId)
+			return core.NewUnlockConnectorConfirmation(core.UnlockStatusUnlockFailed), nil
+		}
+		go func() {
+			handler.StopRemoteScenario(connectorId)
+			resetCurrentTx(connectorId)
+		}()
+		return core.NewUnlockConnectorConfirmation(core.UnlockStatusUnlocked), nil
+	}
 
-				appLogger.Infoln("Transaction stopped", tagInfo.Status, request.TransactionId)
-				return
-			default:
-				appLogger.Println("Transaction won't stop", txId, tagInfo.Status)
+	// an idle connector becomes Preparing as when a cable is plugged in
+	if connectorStatus(connectorId) == core.ChargePointStatusAvailable {
+		go func() {
+			if err := setConnectorStatus(connectorId, core.ChargePointStatusPreparing, core.NoError); err == nil {
+				expirePreparing(connectorId)
 			}
-			return
+		}()
+	}
+	return core.NewUnlockConnectorConfirmation(core.UnlockStatusUnlocked), nil
+}
 
-		}
-		appLogger.Println("StopTransactionConfirmation", resp, protoError)
-	})
+// expirePreparing puts the connector back to its idle status when no
+// transaction started within ConnectionTimeOut seconds of it becoming
+// Preparing.
+func expirePreparing(connectorId int) {
+	time.Sleep(time.Duration(MustGetIntKey("ConnectionTimeOut")) * time.Second)
+	if !isTxRunning(connectorId) && connectorStatus(connectorId) == core.ChargePointStatusPreparing {
+		appLogger.WithField("connector_id", connectorId).Println("ConnectionTimeOut expired")
+		setIdleStatus(connectorId)
+	}
+}
+
+// startTransaction starts charging on the connector for the idTag, using the
+// connector's reservation, and queues the StartTransaction. The transaction
+// runs under a local id until the central system assigned its own, the
+// TxProfile if any is installed then.
+func startTransaction(connectorId int, idTag string, res *Reservation, profile *types.ChargingProfile) error {
+	if !isRegistered() {
+		return errNotRegistered
+	}
+	startEnergyValue := MustGetIntKey(meterValueKey(EnergyKey, connectorId))
+	req := core.NewStartTransactionRequest(connectorId,
+		idTag,
+		startEnergyValue,
+		types.NewDateTime(clockNow()))
+	if res != nil {
+		req.ReservationId = &res.ReservationId
+	}
+
+	localTxId, err := nextLocalTxId()
+	if err != nil {
+		return err
+	}
+	if err := setTxIdTag(idTag, connectorId); err != nil {
+		return err
+	}
+	if err := setTxId(localTxId, connectorId); err != nil {
+		return err
+	}
+	if res != nil {
+		deleteReservation(res.ConnectorId)
+	}
+	if err := queueTransactionMessage(connectorId, localTxId, req, profile); err != nil {
+		resetCurrentTx(connectorId)
+		return err
+	}
+
+	go handler.RunRemoteScenario(connectorId, localTxId)
 
-	return core.NewRemoteStopTransactionConfirmation(types.RemoteStartStopStatusAccepted), err
+	appLogger.Infoln("Transaction started", connectorId, localTxId)
+	return nil
 }
 
-func (handler *ChargePointHandler) OnUnlockConnector(request *core.UnlockConnectorRequest) (confirmation *core.UnlockConnectorConfirmation, err error) {
-	connectorId := request.ConnectorId
-	appLogger.Println("OnUnlockConnector", connectorId)
+// handleInvalidIdTag ends a transaction whose idTag was not accepted when
+// StopTransactionOnInvalidId is set, otherwise the transaction goes on with the
+// EVSE suspended.
+func handleInvalidIdTag(connectorId, txId int) {
+	if !MustGetBoolKey("StopTransactionOnInvalidId") {
+		db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(txKey(connectorId, "deauthorized")), []byte("true"))
+		})
+		setConnectorStatus(connectorId, core.ChargePointStatusSuspendedEVSE, core.NoError)
+		return
+	}
 
-	go func() {
-		setCurrentTxConnectorId(connectorId)
-		statusNotification(core.ChargePointStatusPreparing, 0)
-	}()
+	if err := stopTransaction(connectorId, core.ReasonDeAuthorized); err != nil {
+		appLogger.WithError(err).Error("Error stopping transaction ", txId)
+	}
+	handler.StopRemoteScenario(connectorId)
+	resetCurrentTx(connectorId)
+}
 
-	go func() {
-		time.Sleep(2 * time.Minute)
-		if !isTxRunning() {
-			setCurrentTxConnectorId(0)
-			statusNotification(core.ChargePointStatusAvailable, 0)
-			return
-		}
-	}()
-	return core.NewUnlockConnectorConfirmation(core.UnlockStatusUnlocked), nil
+// isTxDeauthorized tells whether the transaction on the connector goes on
+// although its idTag was not accepted.
+func isTxDeauthorized(connectorId int) bool {
+	ext, _ := KeyExists(txKey(connectorId, "deauthorized"))
+	return ext
+}
+
+// installTxProfile installs the charging profile received with
+// RemoteStartTransaction for the transaction that just started.
+func installTxProfile(connectorId, txId int, profile *types.ChargingProfile) {
+	profile.TransactionId = txId
+	err := validateChargingProfile(connectorId, profile)
+	if err == nil {
+		err = installChargingProfile(connectorId, profile)
+	}
+	if err != nil {
+		appLogger.WithError(err).
+			WithField("chargingProfileId", profile.ChargingProfileId).
+			WithField("transactionId", txId).
+			Println("Error installing TxProfile")
+	}
+}
+
+// stopTransaction queues the StopTransaction of the transaction running on
+// the connector.
+func stopTransaction(connectorId int, reason core.Reason) error {
+	req := core.NewStopTransactionRequest(MustGetIntKey(meterValueKey(EnergyKey, connectorId)),
+		types.NewDateTime(clockNow()), currentTxId(connectorId))
+	req.Reason = reason
+	req.IdTag = currentTxIdTag(connectorId)
+
+	return queueTransactionMessage(connectorId, currentLocalTxId(connectorId), req, nil)
+}
+
+func txKey(connectorId int, name string) string {
+	return fmt.Sprintf("connector__%d__transaction_%s", connectorId, name)
 }
 
-func isTxRunning() bool {
-	ext, _ := KeyExists("current_transaction_id")
+func isTxRunning(connectorId int) bool {
+	ext, _ := KeyExists(txKey(connectorId, "id"))
 	return ext
 }
 
-func currentTxConnectorId() int {
-	id, _ := GetIntKey("current_transaction_connector_id")
-	return id
+func isAnyTxRunning() bool {
+	for id := 1; id <= numberOfConnectors(); id++ {
+		if isTxRunning(id) {
+			return true
+		}
+	}
+	return false
 }
 
-func setCurrentTxConnectorId(id int) error {
-	return db.Update(func(txn *badger.Txn) error {
-		txn.Set([]byte("current_transaction_connector_id"), []byte(strconv.Itoa(id)))
-		return nil
-	})
+// freeConnectorId returns the first operative connector without a
+// transaction.
+func freeConnectorId() (int, bool) {
+	for id := 1; id <= numberOfConnectors(); id++ {
+		if isOperative(id) && !isTxRunning(id) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// txConnectorId returns the connector the transaction is running on.
+func txConnectorId(txId int) (int, bool) {
+	for id := 1; id <= numberOfConnectors(); id++ {
+		if isTxRunning(id) && currentTxId(id) == txId {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func currentTxId(connectorId int) int {
+	id, _ := GetIntKey(txKey(connectorId, "id"))
+	return id
 }
 
-func currentTxId() int {
-	id, _ := GetIntKey("current_transaction_id")
+// currentLocalTxId returns the local id the transaction running on the
+// connector started with, it doesn't change once the central system assigned
+// its own id.
+func currentLocalTxId(connectorId int) int {
+	ext, _ := KeyExists(txKey(connectorId, "local_id"))
+	if !ext {
+		return currentTxId(connectorId)
+	}
+	id, _ := GetIntKey(txKey(connectorId, "local_id"))
 	return id
 }
 
+// setTxId starts the transaction on the connector under its local id.
 func setTxId(id, connectorId int) error {
 	return db.Update(func(txn *badger.Txn) error {
-		txn.Set([]byte("current_transaction_id"), []byte(strconv.Itoa(id)))
-		txn.Set([]byte("current_transaction_connector_id"), []byte(strconv.Itoa(connectorId)))
+		txn.Set([]byte(txKey(connectorId, "id")), []byte(strconv.Itoa(id)))
+		txn.Set([]byte(txKey(connectorId, "local_id")), []byte(strconv.Itoa(id)))
+		txn.Set([]byte(txKey(connectorId, "started_at")), []byte(time.Now().Format(time.RFC3339)))
 		return nil
 	})
 }
 
-func resetCurrentTx() error {
+func resetCurrentTx(connectorId int) error {
 	return db.Update(func(txn *badger.Txn) error {
-		txn.Delete([]byte("current_transaction_id"))
-		txn.Delete([]byte("current_transaction_connector_id"))
-		txn.Delete([]byte("current_transaction_idTag"))
+		if err := deleteTxProfilesTX(txn, connectorId); err != nil {
+			return err
+		}
+		txn.Delete([]byte(txKey(connectorId, "id")))
+		txn.Delete([]byte(txKey(connectorId, "local_id")))
+		txn.Delete([]byte(txKey(connectorId, "idTag")))
+		txn.Delete([]byte(txKey(connectorId, "started_at")))
+		txn.Delete([]byte(txKey(connectorId, "deauthorized")))
 		for _, key := range flushableMeterValues {
-			txn.Delete([]byte(key))
+			txn.Delete([]byte(meterValueKey(key, connectorId)))
 		}
 		return nil
 	})
 }
 
-func currentTxIdTag() string {
-	tag, _ := GetKeyValue("current_transaction_idTag")
+// txStartedAt returns when the transaction running on the connector started,
+// or fallback when there is none.
+func txStartedAt(connectorId int, fallback time.Time) time.Time {
+	if !isTxRunning(connectorId) {
+		return fallback
+	}
+	v, _ := GetKeyValue(txKey(connectorId, "started_at"))
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return fallback
+	}
+	return t
+}
+
+func currentTxIdTag(connectorId int) string {
+	tag, _ := GetKeyValue(txKey(connectorId, "idTag"))
 	return tag
 }
 
-func setTxIdTag(tag string) error {
+func setTxIdTag(tag string, connectorId int) error {
 	return db.Update(func(txn *badger.Txn) error {
-		txn.Set([]byte("current_transaction_idTag"), []byte(tag))
+		txn.Set([]byte(txKey(connectorId, "idTag")), []byte(tag))
 		return nil
 	})
 }
+
+// migrateLegacyTransactionTX moves the transaction and meter values stored by
+// single connector versions under the connector they belong to.
+func migrateLegacyTransactionTX(txn *badger.Txn) error {
+	connectorId := 1
+	if id, err := GetIntKeyTX(txn, "current_transaction_connector_id"); err == nil && id > 0 {
+		connectorId = id
+	}
+	moves := map[string]string{
+		"current_transaction_id":         txKey(connectorId, "id"),
+		"current_transaction_idTag":      txKey(connectorId, "idTag"),
+		"current_transaction_started_at": txKey(connectorId, "started_at"),
+		EnergyKey:                        meterValueKey(EnergyKey, connectorId),
+	}
+	for _, key := range flushableMeterValues {
+		moves[key] = meterValueKey(key, connectorId)
+	}
+	for from, to := range moves {
+		v, err := GetKeyValueTX(txn, from)
+		if err != nil {
+			return err
+		}
+		if v == "" {
+			continue
+		}
+		if err := txn.Set([]byte(to), []byte(v)); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte(from)); err != nil {
+			return err
+		}
+	}
+	return txn.Delete([]byte("current_transaction_connector_id"))
+}
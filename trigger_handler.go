@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/core"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/firmware"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/logging"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/remotetrigger"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/securefirmware"
+	"github.com/lorenzodonini/ocpp-go/ocpp1.6/types"
+)
+
+var errTriggerNotImplemented = errors.New("trigger not implemented")
+
+func (handler *ChargePointHandler) OnTriggerMessage(request *remotetrigger.TriggerMessageRequest) (confirmation *remotetrigger.TriggerMessageConfirmation, err error) {
+	appLogger.Println("OnTriggerMessage", request.RequestedMessage, request.ConnectorId)
+
+	send, err := triggeredMessage(string(request.RequestedMessage), request.ConnectorId)
+	if err != nil {
+		appLogger.WithError(err).Println("TriggerMessage not accepted", request.RequestedMessage)
+		if errors.Is(err, errTriggerNotImplemented) {
+			return remotetrigger.NewTriggerMessageConfirmation(remotetrigger.TriggerMessageStatusNotImplemented), nil
+		}
+		return remotetrigger.NewTriggerMessageConfirmation(remotetrigger.TriggerMessageStatusRejected), nil
+	}
+
+	sendTriggeredMessage(string(request.RequestedMessage), send)
+	return remotetrigger.NewTriggerMessageConfirmation(remotetrigger.TriggerMessageStatusAccepted), nil
+}
+
+// triggeredMessage returns the function sending the requested message, or an
+// error when it cannot be triggered.
+func triggeredMessage(message string, connectorId *int) (func() error, error) {
+	if connectorId != nil && (*connectorId < 0 || *connectorId > numberOfConnectors()) {
+		return nil, fmt.Errorf("unknown connector %d", *connectorId)
+	}
+
+	switch message {
+	case core.BootNotificationFeatureName:
+		return bootNotification, nil
+
+	case core.HeartbeatFeatureName:
+		return sendHeartbeat, nil
+
+	case core.MeterValuesFeatureName:
+		if connectorId != nil && *connectorId == 0 {
+			return nil, errors.New("meter values cannot be triggered for connector 0")
+		}
+		return func() error {
+			for _, id := range triggeredConnectors(connectorId, 1) {
+				if err := sendConnectorMeterValues(id, types.ReadingContextTrigger); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+
+	case core.StatusNotificationFeatureName:
+		return func() error {
+			for _, id := range triggeredConnectors(connectorId, 0) {
+				if err := sendConnectorStatus(id); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+
+	case firmware.DiagnosticsStatusNotificationFeatureName:
+		return func() error {
+			_, err := chargePoint.DiagnosticsStatusNotification(currentDiagnosticsStatus())
+			return err
+		}, nil
+
+	case firmware.FirmwareStatusNotificationFeatureName:
+		return func() error {
+			_, err := chargePoint.FirmwareStatusNotification(currentFirmwareStatus())
+			return err
+		}, nil
+
+	}
+	return nil, errTriggerNotImplemented
+}
+
+// extendedTriggeredMessage returns the action of the message sent for an
+// ExtendedTriggerMessage and the function sending it. The firmware status is
+// the one of the signed firmware updates.
+func extendedTriggeredMessage(message string, connectorId *int) (string, func() error, error) {
+	switch message {
+	case firmware.FirmwareStatusNotificationFeatureName:
+		return "SignedFirmwareStatusNotification", func() error {
+			status, requestId := currentSignedFirmwareStatus()
+			req := securefirmware.NewSignedFirmwareStatusNotificationRequest(status)
+			if status != securefirmware.FirmwareStatusIdle {
+				req.RequestID = &requestId
+			}
+			_, err := chargePoint.SendRequest(req)
+			return err
+		}, nil
+
+	case "LogStatusNotification":
+		return message, func() error {
+			status, requestId := currentLogStatus()
+			_, err := chargePoint.SendRequest(logging.NewLogStatusNotificationRequest(status, requestId))
+			return err
+		}, nil
+
+	case "SignChargePointCertificate":
+		if cpoName, _ := GetKeyValue("CpoName"); cpoName == "" {
+			return "", nil, errors.New("CpoName is required to sign the charge point certificate")
+		}
+		return "SignCertificate", requestCertificateSigning, nil
+	}
+
+	send, err := triggeredMessage(message, connectorId)
+	return message, send, err
+}
+
+// sendTriggeredMessage sends the message of the action once the trigger was
+// confirmed.
+func sendTriggeredMessage(action string, send func() error) {
+	afterConfirmation(func() {
+		done := allowTriggered(action)
+		defer done()
+		if err := send(); err != nil {
+			appLogger.WithError(err).Error("Error sending triggered ", action)
+			return
+		}
+		appLogger.Println("Triggered message sent", action)
+	})
+}
+
+// triggeredConnectors returns the connectors a trigger applies to, all of them
+// starting at first when no connector was requested.
+func triggeredConnectors(connectorId *int, first int) []int {
+	if connectorId != nil {
+		return []int{*connectorId}
+	}
+	ids := []int{}
+	for id := first; id <= numberOfConnectors(); id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func numberOfConnectors() int {
+	n := MustGetIntKey("NumberOfConnectors")
+	if n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// The current*Status functions return what a triggered status notification
+// reports: the status of the operation in progress, or Idle once the last one
+// ended whatever its outcome.
+
+func currentDiagnosticsStatus() firmware.DiagnosticsStatus {
+	status, _ := GetKeyValue("diagnostics_status")
+	if status == "" {
+		return firmware.DiagnosticsStatusIdle
+	}
+	return firmware.DiagnosticsStatus(status)
+}
+
+func currentFirmwareStatus() firmware.FirmwareStatus {
+	status, _ := GetKeyValue("firmware_status")
+	if status == "" {
+		return firmware.FirmwareStatusIdle
+	}
+	return firmware.FirmwareStatus(status)
+}
+
+func currentSignedFirmwareStatus() (securefirmware.FirmwareStatus, int) {
+	status, _ := GetKeyValue("signed_firmware_status")
+	if status == "" {
+		status = string(securefirmware.FirmwareStatusIdle)
+	}
+	return securefirmware.FirmwareStatus(status), MustGetIntKey("signed_firmware_request_id")
+}
+
+func currentLogStatus() (logging.UploadLogStatus, int) {
+	status, _ := GetKeyValue("log_status")
+	if status == "" {
+		status = string(logging.UploadLogStatusIdle)
+	}
+	return logging.UploadLogStatus(status), MustGetIntKey("log_request_id")
+}